@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 
@@ -9,36 +11,74 @@ import (
 )
 
 func main() {
-	args := os.Args
-	if len(args) <= 1 {
-		panic("need rom path.")
+	tracePath := flag.String("trace", "", "write a nestest-format CPU trace to `file`")
+	cycleAccurate := flag.Bool("cycle", false, "run the CPU cycle by cycle (more accurate, slower)")
+	audioSync := flag.Bool("audiosync", false, "pace emulation by the audio buffer instead of the clock")
+	stereo := flag.Bool("stereo", false, "output stereo audio (channel pan is set through the mixer)")
+	regionName := flag.String("region", "", "force the console `region`: ntsc, pal or dendy (default: detect from the ROM)")
+	listMappers := flag.Bool("mappers", false, "list supported mappers and exit")
+	flag.Parse()
+	if *listMappers {
+		for _, m := range nes.Mappers() {
+			fmt.Printf("%3d  %s\n", m.Number, m.Name)
+		}
+		return
 	}
-	filePath := args[1]
+	if flag.NArg() < 1 {
+		exit("usage: %s [-trace file] [-cycle] [-region name] <rom path>", os.Args[0])
+	}
+	filePath := flag.Arg(0)
 	info, err := os.Stat(filePath)
 	if err != nil {
-		panic(err)
+		exit("%v", err)
 	}
 	if info.IsDir() {
-		panic("invalid path.")
+		exit("invalid path: %s is a directory", filePath)
 	}
 
 	// 调试用
 	// filePath := "/Users/utahcoder/Desktop/nes-roms/中东战争.nes"
 
-	file, err := os.Open(filePath)
+	fileData, err := ioutil.ReadFile(filePath)
 	if err != nil {
-		panic(err)
-	}
-	defer file.Close()
-
-	fileData, err2 := ioutil.ReadAll(file)
-	if err2 != nil {
-		panic(err2)
+		exit("%v", err)
 	}
 
 	console, err := nes.NewConsole(fileData)
 	if err != nil {
-		panic(err)
+		exit("load %s: %v", filePath, err)
+	}
+	if *regionName != "" {
+		region, err := nes.ParseRegion(*regionName)
+		if err != nil {
+			exit("%v", err)
+		}
+		console.SetRegion(region)
 	}
-	ui.OpenWindow(console)
+	console.SetCycleAccurate(*cycleAccurate)
+	var tracer *nes.TraceLogger
+	if *tracePath != "" {
+		tracer, err = nes.CreateTraceFile(*tracePath, console)
+		if err != nil {
+			exit("%v", err)
+		}
+		console.CPU.SetTracer(tracer)
+	}
+	ui.SyncToAudio = *audioSync
+	ui.Stereo = *stereo
+	ui.OpenWindow(console, filePath)
+	// OpenWindow返回时模拟已经停下，摘掉tracer之后再关闭文件
+	if tracer != nil {
+		ui.WithConsoleLock(func() {
+			console.CPU.SetTracer(nil)
+		})
+		if err := tracer.Close(); err != nil {
+			exit("close trace: %v", err)
+		}
+	}
+}
+
+func exit(format string, a ...interface{}) {
+	fmt.Fprintf(os.Stderr, format+"\n", a...)
+	os.Exit(1)
 }
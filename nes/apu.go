@@ -45,10 +45,28 @@ func init() {
 type APU struct {
 	// channel    chan float32
 	outputWork func(float32)
-	sampleRate float64
+	muted      bool
+	blip       [2]blipBuffer  // 带限合成，把每个时钟的电平转成输出采样率，立体声时用两个
+	filters    [2]filterChain // 输出前经过的高通/低通滤波
+
+	// 立体声输出
+	stereo     bool
+	stereoWork func(left, right float32)
+
+	// 混音设置，gain是换算后的各声道增益
+	mixer        Mixer
+	mixerDefault bool
+	gainMono     [ChannelCount]float32
+	gainLeft     [ChannelCount]float32
+	gainRight    [ChannelCount]float32
+	// StepFrame期间把采样收集起来
+	recording  bool
+	samples    []float32
 	console    *Console
 	cycle      uint64
 	last_cycle uint64
+	// 帧计数器每步的CPU时钟数，随区域变化
+	framePeriod float64
 
 	pulse1 Pulse
 	pulse2 Pulse
@@ -63,9 +81,7 @@ type APU struct {
 	frameForbidIRQ byte // 中断禁止标志 0：使能中断，1：禁用中断
 	frameCounter   uint64
 
-	dmcIRQ    byte // DMC的IRQ标志
-	frameIRQ  byte // 帧中断标志, 如果为1, 会确认IRQ, 返回1置为0
-	dmcActive byte // DMC还有剩余样本(剩余字节>0)
+	frameIRQ byte // 帧中断标志, 如果为1, 会确认IRQ, 返回1置为0
 }
 
 type Pulse struct {
@@ -314,6 +330,7 @@ type Noise struct {
 	envelopeValue   byte
 	envelopeVolume  byte
 	constantVolume  byte
+	periods         []uint16 // 周期表，随区域变化
 }
 
 // $400C	--lc.vvvv	Length counter halt, constant volume/envelope flag, const volume/envelope divider period (write)
@@ -330,7 +347,7 @@ func (n *Noise) writeEnvelope(value byte) {
 
 func (n *Noise) writeTimerPeriod(value byte) {
 	n.shortMode = (value>>7)&1 > 0
-	n.timerPeriod = noiseTable[uint16(value&0xf)]
+	n.timerPeriod = n.periods[value&0xf]
 }
 
 func (n *Noise) writeLength(value byte) {
@@ -413,14 +430,19 @@ type DMC struct {
 	tickPeriod     byte
 	tickValue      byte
 	loop           bool
-	irq            bool
+	irq            bool   // 采样结束时产生IRQ
+	irqFlag        bool   // DMC的IRQ标志
+	periods        []byte // 周期表，随区域变化
 }
 
 // $4010
 func (d *DMC) writePeriod(value byte) {
 	d.irq = (value >> 7) > 0
-	d.loop = (value >> 6) > 0
-	d.tickPeriod = dmcTable[value&0xf]
+	if !d.irq {
+		d.clearIRQ()
+	}
+	d.loop = (value>>6)&1 > 0
+	d.tickPeriod = d.periods[value&0xf]
 }
 
 // $4011
@@ -460,20 +482,29 @@ func (d *DMC) stepTimer() {
 
 func (d *DMC) stepReader() {
 	if d.currentLength > 0 && d.bitCount == 0 {
-		d.cpu.stall += 4
-		d.shiftRegister = d.cpu.Read(d.currentAddress)
+		d.shiftRegister = d.cpu.dmcRead(d.currentAddress)
 		d.bitCount = 8
 		d.currentAddress++
 		if d.currentAddress == 0 {
 			d.currentAddress = 0x8000
 		}
 		d.currentLength--
-		if d.currentLength == 0 && d.loop {
-			d.restart()
+		if d.currentLength == 0 {
+			if d.loop {
+				d.restart()
+			} else if d.irq {
+				d.irqFlag = true
+				d.cpu.SetIRQ(IRQDMC, true)
+			}
 		}
 	}
 }
 
+func (d *DMC) clearIRQ() {
+	d.irqFlag = false
+	d.cpu.SetIRQ(IRQDMC, false)
+}
+
 func (d *DMC) stepShifter() {
 	if d.bitCount == 0 {
 		return
@@ -503,32 +534,93 @@ func NewAPU(console *Console) *APU {
 	apu.pulse2.channel = 2
 
 	apu.dmc.cpu = console.CPU
+	apu.setTiming(RegionNTSC.timing())
+	apu.setMixer(DefaultMixer())
 	return &apu
 }
 
+// 切换区域时更新帧计数器间隔和噪声/DMC周期表，已经写入的周期等下次写寄存器时生效
+func (apu *APU) setTiming(t *regionTiming) {
+	apu.framePeriod = t.framePeriod
+	apu.noise.periods = t.noiseTable
+	apu.dmc.periods = t.dmcTable
+}
+
 func (apu *APU) Step() {
 	// APU基本时钟频率是cpu的一半, 三角波不是
 
 	apu.stepTimer()
 
-	// cycle时钟达到了240Hz
-	if float64(apu.cycle-apu.last_cycle) >= float64(CPUFrequency)/FrameCounterRate {
+	// cycle时钟达到了240Hz(PAL为200Hz)
+	if float64(apu.cycle-apu.last_cycle) >= apu.framePeriod {
 		apu.stepFrameCounter()
 		apu.last_cycle = apu.cycle
 	}
 
-	s1 := int(float64(apu.cycle) / apu.sampleRate)
-	s2 := int(float64(apu.cycle+1) / apu.sampleRate)
-	if s1 != s2 {
-		apu.sendSample()
+	// 没有设置采样率时不出声音
+	if apu.blip[0].step > 0 {
+		if apu.stereo {
+			apu.stepStereo()
+		} else if sample, ok := apu.blip[0].clock(apu.output()); ok {
+			apu.sendSample(apu.filters[0].step(sample))
+		}
 	}
 
 	apu.cycle++
 }
 
-func (apu *APU) sendSample() {
-	output := apu.output()
+// 设置输出采样率，cpuFrequency为当前区域的CPU时钟频率
+func (apu *APU) setSampleRate(cpuFrequency, sampleRate float64) {
+	for i := range apu.blip {
+		apu.blip[i].step = sampleRate / cpuFrequency
+		apu.filters[i].setSampleRate(sampleRate)
+	}
+}
+
+// 切换立体声时右声道从左声道的状态开始，两边的采样时刻保持一致
+func (apu *APU) setStereo(callback func(left, right float32)) {
+	apu.stereoWork = callback
+	apu.stereo = callback != nil
+	apu.blip[1] = apu.blip[0]
+	apu.filters[1] = apu.filters[0]
+}
+
+func (apu *APU) setMixer(mixer Mixer) {
+	apu.mixer = mixer
+	apu.mixerDefault = mixer.isDefault()
+	apu.gainMono, apu.gainLeft, apu.gainRight = mixer.gains()
+}
+
+func (apu *APU) stepStereo() {
+	left, right := apu.stereoOutput()
+	l, ok := apu.blip[0].clock(left)
+	r, _ := apu.blip[1].clock(right)
+	if ok {
+		apu.sendStereoSample(apu.filters[0].step(l), apu.filters[1].step(r))
+	}
+}
+
+// StepFrame收集的采样左右交错
+func (apu *APU) sendStereoSample(left, right float32) {
+	if apu.muted {
+		return
+	}
+	if apu.recording {
+		apu.samples = append(apu.samples, left, right)
+	}
+	if apu.stereoWork != nil {
+		apu.stereoWork(left, right)
+	}
+}
+
+func (apu *APU) sendSample(output float32) {
 	// apu.channel <- output
+	if apu.muted {
+		return
+	}
+	if apu.recording {
+		apu.samples = append(apu.samples, output)
+	}
 	if apu.outputWork != nil {
 		apu.outputWork(output)
 	}
@@ -620,7 +712,40 @@ output = square_out + tnd_out
 */
 
 // 最终输出
+// 各声道当前的电平
+func (apu *APU) levels() [ChannelCount]float32 {
+	return [ChannelCount]float32{
+		float32(apu.pulse1.output()),
+		float32(apu.pulse2.output()),
+		float32(apu.triangle.output()),
+		float32(apu.noise.output()),
+		float32(apu.dmc.output()),
+		apu.expansionOutput(),
+	}
+}
+
+// 卡带上扩展音源的输出，作为ChannelExpansion参与混音
+func (apu *APU) expansionOutput() float32 {
+	if audio := apu.console.audio; audio != nil {
+		return audio.AudioOutput()
+	}
+	return 0
+}
+
+func (apu *APU) stereoOutput() (float32, float32) {
+	if apu.mixerDefault {
+		output := apu.output()
+		return output, output
+	}
+	levels := apu.levels()
+	return mixLevels(&levels, &apu.gainLeft), mixLevels(&levels, &apu.gainRight)
+}
+
 func (apu *APU) output() float32 {
+	if !apu.mixerDefault {
+		levels := apu.levels()
+		return mixLevels(&levels, &apu.gainMono)
+	}
 	p1 := apu.pulse1.output()
 	p2 := apu.pulse2.output()
 	t := apu.triangle.output()
@@ -630,15 +755,21 @@ func (apu *APU) output() float32 {
 	pulseOut := pulseTable[p1+p2]
 	tndOut := tndTable[3*t+2*n+dmc]
 
-	return pulseOut + tndOut
+	return pulseOut + tndOut + apu.expansionOutput()
 }
 
 func (apu *APU) triggerIRQ() {
 	if apu.frameForbidIRQ == 0 {
-		apu.console.CPU.TriggerIRQ()
+		apu.frameIRQ = 1
+		apu.console.CPU.SetIRQ(IRQFrame, true)
 	}
 }
 
+func (apu *APU) clearFrameIRQ() {
+	apu.frameIRQ = 0
+	apu.console.CPU.SetIRQ(IRQFrame, false)
+}
+
 func (apu *APU) writeRegister(addr uint16, value byte) {
 	switch addr {
 	case 0x4000:
@@ -691,6 +822,9 @@ func (apu *APU) writeRegister(addr uint16, value byte) {
 func (apu *APU) writeFrameCounter(value byte) {
 	apu.frameMode = (value >> 7) & 1
 	apu.frameForbidIRQ = (value >> 6) & 1
+	if apu.frameForbidIRQ == 1 {
+		apu.clearFrameIRQ()
+	}
 
 	// 5步模式
 	if apu.frameMode == 1 {
@@ -710,9 +844,13 @@ func (apu *APU) ReadRegister(addr uint16) byte {
 // 0x4015 APU状态寄存器，唯一可读寄存器
 func (apu *APU) readStatus(addr uint16) byte {
 	var status byte
-	status |= (apu.dmcIRQ << 7)
+	if apu.dmc.irqFlag {
+		status |= 1 << 7
+	}
 	status |= (apu.frameIRQ << 6)
-	status |= (apu.dmcActive << 4)
+	if apu.dmc.currentLength > 0 {
+		status |= 1 << 4
+	}
 	if apu.noise.lengthValue > 0 {
 		status |= (1 << 3)
 	}
@@ -725,13 +863,15 @@ func (apu *APU) readStatus(addr uint16) byte {
 	if apu.pulse1.lengthValue > 0 {
 		status |= 1
 	}
+	// 读取后清除帧中断标志
+	apu.clearFrameIRQ()
 	return status
 }
 
 func (apu *APU) writeStatus(value byte) {
-	apu.dmcIRQ = (value >> 7) & 1
-	apu.frameIRQ = (value >> 6) & 1
-	apu.dmcActive = (value >> 4) & 1
+	// 写$4015清除DMC的IRQ标志，帧中断标志不变
+	apu.dmc.clearIRQ()
+	apu.dmc.enabled = (value>>4)&1 > 0
 
 	apu.pulse1.enabled = value&1 > 0
 	apu.pulse2.enabled = (value>>1)&1 > 0
@@ -762,6 +902,91 @@ func (apu *APU) writeStatus(value byte) {
 	}
 }
 
+func (apu *APU) serialize(s *Serializer) {
+	s.Uint64(&apu.cycle)
+	s.Uint64(&apu.last_cycle)
+	apu.pulse1.serialize(s)
+	apu.pulse2.serialize(s)
+	apu.triangle.serialize(s)
+	apu.noise.serialize(s)
+	apu.dmc.serialize(s)
+	s.Byte(&apu.frameMode)
+	s.Byte(&apu.frameForbidIRQ)
+	s.Uint64(&apu.frameCounter)
+	s.Byte(&apu.frameIRQ)
+}
+
+func (p *Pulse) serialize(s *Serializer) {
+	s.Bool(&p.enabled)
+	s.Byte(&p.channel)
+	s.Byte(&p.dutyMode)
+	s.Byte(&p.dutyValue)
+	s.Bool(&p.lengthEnable)
+	s.Byte(&p.lengthValue)
+	s.Uint16(&p.timerPeriod)
+	s.Uint16(&p.timerValue)
+	s.Bool(&p.envelopeEnable)
+	s.Bool(&p.envelopeLoop)
+	s.Bool(&p.envelopeStart)
+	s.Byte(&p.envelopePeriod)
+	s.Byte(&p.envelopeValue)
+	s.Byte(&p.envelopeVolume)
+	s.Bool(&p.constVolumeEnable)
+	s.Byte(&p.constVolume)
+	s.Bool(&p.sweepEnable)
+	s.Byte(&p.sweepPeriod)
+	s.Byte(&p.sweepReverse)
+	s.Byte(&p.sweepShift)
+	s.Byte(&p.sweepValue)
+	s.Bool(&p.sweepReload)
+}
+
+func (t *Triangle) serialize(s *Serializer) {
+	s.Bool(&t.enabled)
+	s.Uint16(&t.timerPeriod)
+	s.Uint16(&t.timerValue)
+	s.Byte(&t.dutyValue)
+	s.Bool(&t.lengthEnable)
+	s.Byte(&t.lengthValue)
+	s.Bool(&t.lengthReload)
+	s.Bool(&t.linearEnable)
+	s.Byte(&t.linearValue)
+	s.Byte(&t.linearReloadValue)
+}
+
+func (n *Noise) serialize(s *Serializer) {
+	s.Bool(&n.enabled)
+	s.Bool(&n.shortMode)
+	s.Uint16(&n.shiftRegister)
+	s.Bool(&n.lengthEnabled)
+	s.Byte(&n.lengthValue)
+	s.Uint16(&n.timerPeriod)
+	s.Uint16(&n.timerValue)
+	s.Bool(&n.envelopeEnabled)
+	s.Bool(&n.envelopeLoop)
+	s.Bool(&n.envelopeStart)
+	s.Byte(&n.envelopePeriod)
+	s.Byte(&n.envelopeValue)
+	s.Byte(&n.envelopeVolume)
+	s.Byte(&n.constantVolume)
+}
+
+func (d *DMC) serialize(s *Serializer) {
+	s.Bool(&d.enabled)
+	s.Byte(&d.value)
+	s.Uint16(&d.sampleAddress)
+	s.Uint16(&d.sampleLength)
+	s.Uint16(&d.currentAddress)
+	s.Uint16(&d.currentLength)
+	s.Byte(&d.shiftRegister)
+	s.Byte(&d.bitCount)
+	s.Byte(&d.tickPeriod)
+	s.Byte(&d.tickValue)
+	s.Bool(&d.loop)
+	s.Bool(&d.irq)
+	s.Bool(&d.irqFlag)
+}
+
 // divider
 // 帧计数器(Frame Counter) / 帧序列器(Frame Sequencer)
 /*
@@ -0,0 +1,58 @@
+package nes
+
+import (
+	"testing"
+)
+
+// $4015的第4位开关DMC: 打开时从头开始播放采样，关闭时剩余长度清零
+func TestDMCEnable(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x4010, 0x8F) // 采样结束时IRQ，最快的速率
+	cpu.Write(0x4012, 0x00) // $C000
+	cpu.Write(0x4013, 0x01) // 17字节
+	if v := cpu.Read(0x4015); v&0x10 != 0 {
+		t.Fatalf("$4015 = %02X before enable, want bit 4 clear", v)
+	}
+
+	cpu.Write(0x4015, 0x10)
+	if v := cpu.Read(0x4015); v&0x10 == 0 {
+		t.Fatalf("$4015 = %02X after enable, want bit 4 set", v)
+	}
+	cpu.Write(0x4015, 0x00)
+	if v := cpu.Read(0x4015); v&0x10 != 0 {
+		t.Fatalf("$4015 = %02X after disable, want bit 4 clear", v)
+	}
+
+	// 17字节 * 8位 * 54个CPU时钟，不到一帧就播完，开机后的第一帧不完整
+	cpu.Write(0x4015, 0x10)
+	console.StepFrame()
+	console.StepFrame()
+	if v := cpu.Read(0x4015); v&0x90 != 0x80 {
+		t.Errorf("$4015 = %02X after sample end, want DMC irq and bit 4 clear", v)
+	}
+	if !console.CPU.IRQ(IRQDMC) {
+		t.Error("DMC irq not asserted")
+	}
+}
+
+// $4010第6位循环播放，第7位是IRQ，循环时不会产生IRQ
+func TestDMCLoop(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x4010, 0xCF)
+	cpu.Write(0x4013, 0x01)
+	cpu.Write(0x4015, 0x10)
+	for i := 0; i < 3; i++ {
+		console.StepFrame()
+	}
+	if v := cpu.Read(0x4015); v&0x90 != 0x10 {
+		t.Errorf("$4015 = %02X, want still playing without irq", v)
+	}
+}
@@ -0,0 +1,96 @@
+package nes
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+)
+
+/*
+blargg的测试rom，把结果写在$6000开始的SRAM里:
+$6000       状态 0x80运行中 0x81需要按reset <0x80结束，0表示通过
+$6001-$6003 DE B0 61，说明状态有效
+$6004       结果说明文字，0结尾
+
+testdata/blargg 下的rom都会用逐周期模式跑一遍，仓库里没有这些rom，需要自己放进来，没有时跳过
+*/
+
+const blarggDir = "testdata/blargg"
+
+// 最多模拟60秒
+const blarggMaxFrames = 60 * 60
+
+func blarggStatus(console *Console) (byte, bool) {
+	m := console.Mapper
+	if m.Read(0x6001) != 0xDE || m.Read(0x6002) != 0xB0 || m.Read(0x6003) != 0x61 {
+		return 0, false
+	}
+	return m.Read(0x6000), true
+}
+
+func blarggText(console *Console) string {
+	var text []byte
+	for addr := uint16(0x6004); addr < 0x8000; addr++ {
+		c := console.Mapper.Read(addr)
+		if c == 0 {
+			break
+		}
+		text = append(text, c)
+	}
+	return string(text)
+}
+
+func runBlargg(t *testing.T, path string) {
+	rom, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	console.SetCycleAccurate(true)
+
+	resetAt := -1
+	for frame := 0; frame < blarggMaxFrames; frame++ {
+		console.runFrame()
+		if err := console.Err(); err != nil {
+			t.Fatal(err)
+		}
+		status, ok := blarggStatus(console)
+		if !ok || status == 0x80 {
+			continue
+		}
+		if status == 0x81 {
+			// 要求至少等100ms再按reset
+			if resetAt < 0 {
+				resetAt = frame + 6
+			} else if frame >= resetAt {
+				console.Reset()
+				resetAt = -1
+			}
+			continue
+		}
+		if status != 0 {
+			t.Fatalf("failed with code %d:\n%s", status, blarggText(console))
+		}
+		return
+	}
+	t.Fatalf("timed out:\n%s", blarggText(console))
+}
+
+func TestBlargg(t *testing.T) {
+	roms, err := filepath.Glob(filepath.Join(blarggDir, "*.nes"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(roms) == 0 {
+		t.Skipf("no roms in %s, see testdata/README.md", blarggDir)
+	}
+	for _, rom := range roms {
+		rom := rom
+		t.Run(filepath.Base(rom), func(t *testing.T) {
+			runBlargg(t, rom)
+		})
+	}
+}
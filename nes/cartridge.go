@@ -1,14 +1,56 @@
 package nes
 
+// CPU/PPU时序，对应NES 2.0头部byte 12的低两位
+const (
+	TimingNTSC  = 0 // RP2C02, 北美/日本
+	TimingPAL   = 1 // RP2C07, 欧洲/澳洲
+	TimingMulti = 2 // 多区域通用
+	TimingDendy = 3 // UA6538, 俄罗斯兼容机
+)
+
+// 主机类型，对应byte 7的低两位，为3时由byte 13的低4位给出扩展类型
+const (
+	ConsoleNES        = 0 // NES/Famicom/Dendy
+	ConsoleVsSystem   = 1 // Nintendo Vs. System
+	ConsolePlaychoice = 2 // Playchoice 10
+	ConsoleFamiclone  = 3 // 支持十进制模式的兼容机，更大的值见nesdev扩展主机类型
+)
+
 type Cartridge struct {
-	PRG    []byte
-	CHR    []byte
-	SRAM   []byte // 卡带SRAM
-	Mirror byte   // 0 水平 1 垂直
-	Mapper byte   // mapper种类
+	PRG     []byte
+	CHR     []byte
+	SRAM    []byte // 卡带SRAM
+	VRAM    []byte // 卡带上额外的显存，四屏卡带有2KB，没有时为nil
+	Mirror  byte   // 0 水平 1 垂直，其他见MirrorHorizontal等
+	Mapper  uint16 // mapper种类，NES 2.0下为12位
+	Battery bool   // SRAM是否带电池，带电池的SRAM需要持久化存档
+
+	// 以下信息来自NES 2.0头部，iNES格式下按默认值填充
+	NES2         bool // 是否为NES 2.0格式
+	SubMapper    byte // 子mapper号
+	PRGRAMSize   int  // 易失PRG-RAM大小(byte)
+	PRGNVRAMSize int  // 带电池PRG-RAM(EEPROM)大小(byte)
+	CHRRAMSize   int  // 易失CHR-RAM大小(byte)
+	CHRNVRAMSize int  // 带电池CHR-RAM大小(byte)
+	Timing       byte // CPU/PPU时序 TimingNTSC/TimingPAL/TimingMulti/TimingDendy
+	ConsoleType  byte // 主机类型
 }
 
-func NewCartridge(prg []byte, chr []byte, mapper byte, mirror byte) *Cartridge {
+func NewCartridge(prg []byte, chr []byte, mapper uint16, mirror byte) *Cartridge {
 	sram := make([]byte, 0x2000)
-	return &Cartridge{prg, chr, sram, mirror, mapper}
+	return &Cartridge{PRG: prg, CHR: chr, SRAM: sram, Mirror: mirror, Mapper: mapper}
+}
+
+// CHR是否为RAM，CHR-RAM的内容需要进存档
+func (card *Cartridge) HasCHRRAM() bool {
+	return card.CHRRAMSize+card.CHRNVRAMSize > 0
+}
+
+func (card *Cartridge) serialize(s *Serializer) {
+	s.Byte(&card.Mirror)
+	s.Bytes(card.SRAM)
+	s.Bytes(card.VRAM)
+	if card.HasCHRRAM() {
+		s.Bytes(card.CHR)
+	}
 }
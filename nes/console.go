@@ -1,6 +1,9 @@
 package nes
 
-import "image"
+import (
+	"fmt"
+	"image"
+)
 
 /**
 这个模块作为cpu/ppu/apu/mapper/card/RAM的封装
@@ -15,6 +18,19 @@ type Console struct {
 	Controller2 *Controller
 	Mapper      Mapper
 	RAM         []byte
+	rewind      *Rewind
+
+	// mapper实现的可选接口，没有实现时为nil
+	ppuBus     PPUBusMapper
+	cpuClocked CPUClockedMapper
+	nameTables NameTableMapper
+	expansion  ExpansionMapper
+	audio      AudioMapper
+
+	region       Region
+	timing       *regionTiming
+	ppuRemainder int64   // PAL下PPU时钟不是CPU的整数倍，记下不足一个PPU时钟的部分(1/5)
+	sampleRate   float64 // 音频采样率，切换区域时重新计算
 }
 
 func NewConsole(info []byte) (*Console, error) {
@@ -28,16 +44,23 @@ func NewConsole(info []byte) (*Console, error) {
 	ctrl2 := NewController()
 
 	console := &Console{
-		nil, nil, nil, card, ctrl1, ctrl2, nil, ram,
+		Card: card, Controller1: ctrl1, Controller2: ctrl2, RAM: ram,
 	}
+	// PPU要在mapper之前创建，mapper创建时可能要用到CIRAM
+	console.PPU = NewPPU(console)
 	mapper, err := NewMapper(card, console)
 	if err != nil {
 		return nil, err
 	}
 	console.Mapper = mapper
+	console.ppuBus, _ = mapper.(PPUBusMapper)
+	console.cpuClocked, _ = mapper.(CPUClockedMapper)
+	console.nameTables, _ = mapper.(NameTableMapper)
+	console.expansion, _ = mapper.(ExpansionMapper)
+	console.audio, _ = mapper.(AudioMapper)
 	console.CPU = NewCPU(console)
-	console.PPU = NewPPU(console)
 	console.APU = NewAPU(console)
+	console.SetRegion(DetectRegion(card))
 
 	return console, nil
 }
@@ -45,25 +68,131 @@ func NewConsole(info []byte) (*Console, error) {
 func (console *Console) Reset() {
 	console.CPU.Reset()
 	console.PPU.Reset()
+	if console.rewind != nil {
+		console.rewind.Reset()
+	}
 }
 
 func (console *Console) Step() int64 {
 	// PPU的时钟是CPU三倍
 	cpuCycles := console.CPU.Step()
-	ppuCycles := cpuCycles * 3
-	for i := 0; int64(i) < ppuCycles; i++ {
+	// 逐周期模式下CPU执行时已经同步运行过了
+	// 否则指令执行完后按CPU时钟逐个补上，PPU/mapper/APU之间的先后顺序和逐周期模式一样
+	if !console.CPU.CycleAccurate() {
+		for i := int64(0); i < cpuCycles; i++ {
+			console.clock()
+		}
+	}
+	if console.rewind != nil {
+		console.rewind.Capture()
+	}
+	return cpuCycles
+}
+
+// CPU时钟数换算成PPU时钟数，NTSC/Dendy是3倍，PAL是3.2倍
+func (console *Console) ppuCycles(cpuCycles int64) int64 {
+	n := cpuCycles*console.timing.ppuRatio + console.ppuRemainder
+	console.ppuRemainder = n % 5
+	return n / 5
+}
+
+// CPU走一个时钟，PPU走三个(PAL平均3.2个)
+func (console *Console) clock() {
+	for i := console.ppuCycles(1); i > 0; i-- {
 		console.PPU.Step()
 		// 部分mapper需要时钟信息
 		console.Mapper.Step()
 	}
-	for j := 0; int64(j) < cpuCycles; j++ {
-		console.APU.Step()
+	if console.cpuClocked != nil {
+		console.cpuClocked.ClockCPU()
+	}
+	console.APU.Step()
+}
+
+// PPU地址总线上出现新地址，通知关心的mapper
+func (console *Console) ppuAddress(addr uint16) {
+	if console.ppuBus != nil {
+		console.ppuBus.PPUAddress(addr)
+	}
+}
+
+// mapper的IRQ输出，电平触发
+func (console *Console) SetMapperIRQ(asserted bool) {
+	console.CPU.SetIRQ(IRQMapper, asserted)
+}
+
+// 切换逐周期模式: CPU每次访问总线时PPU/APU/mapper同步运行，
+// 指令中间的寄存器读写和中断时机更准确，但速度慢一些
+func (console *Console) SetCycleAccurate(enabled bool) {
+	console.CPU.SetCycleAccurate(enabled, console.clock)
+}
+
+// 运行到下一帧开始
+func (console *Console) runFrame() {
+	frame := console.PPU.Frame
+	for frame == console.PPU.Frame {
+		console.Step()
+	}
+}
+
+// 运行一帧，返回这一帧的画面和期间产生的音频采样，不依赖界面和音频设备
+// 需要先用SetAudioSampleRate设置采样率才有音频，SetAudioOutputWork的回调照常调用
+// 画面和采样的内存会被后面的帧复用，需要保留时自行复制
+func (console *Console) StepFrame() (*image.RGBA, []float32) {
+	apu := console.APU
+	apu.samples = apu.samples[:0]
+	apu.recording = true
+	console.runFrame()
+	apu.recording = false
+	return console.Buffer(), apu.samples
+}
+
+// 一帧内两个手柄的按键
+type FrameInput struct {
+	Player1 [8]bool
+	Player2 [8]bool
+}
+
+// 连续运行n帧，每帧开始前按inputs[i]设置按键，inputs比n短时保持最后的按键
+// 同样的ROM和输入每次结果都一样，适合脚本和CI，结束后用Buffer取画面
+// CPU卡死时提前返回*JamError
+func (console *Console) RunFrames(n int, inputs []FrameInput) error {
+	for i := 0; i < n; i++ {
+		if i < len(inputs) {
+			console.SetButton1(inputs[i].Player1)
+			console.SetButton2(inputs[i].Player2)
+		}
+		console.runFrame()
+		if err := console.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// CPU卡死时返回*JamError，否则返回nil
+// 无界面的测试可以每帧检查一次，尽早失败
+func (console *Console) Err() error {
+	cpu := console.CPU
+	if !cpu.Jammed() {
+		return nil
+	}
+	return &JamError{cpu.PC, cpu.peek(cpu.PC)}
+}
+
+// CPU卡死时回调，回调在模拟所在的goroutine中执行
+func (console *Console) SetJamCallback(callback func(err *JamError)) {
+	if callback == nil {
+		console.CPU.onJam = nil
+		return
+	}
+	console.CPU.onJam = func(pc uint16) {
+		callback(&JamError{pc, console.CPU.peek(pc)})
 	}
-	return cpuCycles
 }
 
 func (console *Console) StepSeconds(seconds float64) {
-	cycles := int64(CPUFrequency * seconds)
+	cycles := int64(console.timing.cpuFrequency * seconds)
 	for cycles > 0 {
 		cycles -= console.Step()
 	}
@@ -86,13 +215,110 @@ func (console *Console) SetAudioOutputWork(callback func(float32)) {
 	console.APU.outputWork = callback
 }
 
+// 立体声输出，设置后SetAudioOutputWork的单声道回调不再调用，传nil切回单声道
+// 左右声道按混音设置里的声像分配
+func (console *Console) SetAudioStereoOutputWork(callback func(left, right float32)) {
+	console.APU.setStereo(callback)
+}
+
+// 设置各声道的静音、独奏、音量和声像
+func (console *Console) SetMixer(mixer Mixer) {
+	console.APU.setMixer(mixer)
+}
+
+func (console *Console) Mixer() Mixer {
+	return console.APU.mixer
+}
+
+// 静音时APU照常运行，只是不输出采样
+func (console *Console) SetAudioMuted(muted bool) {
+	console.APU.muted = muted
+}
+
 func (console *Console) SetAudioSampleRate(sampleRate float64) {
 	if sampleRate != 0 {
-		// 将每秒帧率设置为每秒cpu步长
-		console.APU.sampleRate = CPUFrequency / sampleRate
+		console.sampleRate = sampleRate
+		console.APU.setSampleRate(console.timing.cpuFrequency, sampleRate)
 	}
 }
 
+// 切换主机区域，NewConsole时已经按ROM自动识别，这里可以手动覆盖
+// 最好在开始运行前或者reset之后调用
+func (console *Console) SetRegion(region Region) {
+	console.region = region
+	console.timing = region.timing()
+	console.ppuRemainder = 0
+	console.APU.setTiming(console.timing)
+	console.SetAudioSampleRate(console.sampleRate)
+}
+
+func (console *Console) Region() Region {
+	return console.region
+}
+
+// 当前区域下每秒的帧数
+func (console *Console) FrameRate() float64 {
+	return console.region.FrameRate()
+}
+
 func (console *Console) Buffer() *image.RGBA {
 	return console.PPU.front
 }
+
+// 卡带是否带电池SRAM，带电池的游戏需要保存存档
+func (console *Console) HasBattery() bool {
+	return console.Card.Battery
+}
+
+// 导出电池SRAM内容，供前端自行持久化，没有电池时返回nil
+func (console *Console) ExportBatteryRAM() []byte {
+	if !console.Card.Battery {
+		return nil
+	}
+	data := make([]byte, len(console.Card.SRAM))
+	copy(data, console.Card.SRAM)
+	return data
+}
+
+// 导入之前导出的电池SRAM内容，数据比SRAM短时剩余部分清零
+func (console *Console) ImportBatteryRAM(data []byte) error {
+	sram := console.Card.SRAM
+	if len(data) > len(sram) {
+		return fmt.Errorf("nes: battery RAM is %d bytes, cartridge has %d", len(data), len(sram))
+	}
+	n := copy(sram, data)
+	for i := n; i < len(sram); i++ {
+		sram[i] = 0
+	}
+	return nil
+}
+
+// 开启倒带，每interval帧保存一次快照，最多占用budget字节内存
+func (console *Console) EnableRewind(interval int, budget int) {
+	console.rewind = NewRewind(console, interval, budget)
+}
+
+func (console *Console) DisableRewind() {
+	console.rewind = nil
+}
+
+// 倒退frames帧，画面显示倒退后的内容
+// 快照按间隔保存，先回到更早的快照，再静音往前运行到目标帧，至少运行一帧用来刷新画面
+// 返回最终倒退的帧数，没有开启倒带或者没有更早的快照时返回0，快照不够时倒退得少一些
+func (console *Console) RewindFrames(frames int) int {
+	if console.rewind == nil || frames <= 0 {
+		return 0
+	}
+	current := console.PPU.Frame
+	if console.rewind.Rewind(frames+1) == 0 {
+		return 0
+	}
+	muted := console.APU.muted
+	console.APU.muted = true
+	console.runFrame()
+	for console.PPU.Frame < current-frames {
+		console.runFrame()
+	}
+	console.APU.muted = muted
+	return current - console.PPU.Frame
+}
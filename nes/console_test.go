@@ -0,0 +1,187 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+/*
+拼出NES 2.0格式的测试ROM，prgSize/chrSize按字节，没有PRG RAM，需要时自己改头部第10个字节
+每个8KB PRG bank的第一个字节是bank号，每个CHR字节是 1KB bank号<<3 | tile内的行
+prog放在最后一个8KB bank的$E010(16KB PRG时$A010也能读到)，reset和NMI都指向这里
+*/
+func testROM(mapper uint16, subMapper byte, prgSize, chrSize int, prog []byte) []byte {
+	rom := make([]byte, 16+prgSize+chrSize)
+	copy(rom, "NES\x1a")
+	rom[4] = byte(prgSize / 0x4000)
+	rom[5] = byte(chrSize / 0x2000)
+	rom[6] = byte(mapper&0x0F) << 4
+	rom[7] = byte(mapper&0xF0) | 0x08
+	rom[8] = subMapper<<4 | byte(mapper>>8)
+	prg := rom[16 : 16+prgSize]
+	for bank := 0; bank < prgSize/0x2000; bank++ {
+		prg[bank*0x2000] = byte(bank)
+	}
+	chr := rom[16+prgSize:]
+	for i := range chr {
+		chr[i] = byte(i/0x400)<<3 | byte(i&7)
+	}
+	copy(prg[prgSize-0x2000+0x10:], prog)
+	prg[prgSize-6], prg[prgSize-5] = 0x10, 0xE0
+	prg[prgSize-4], prg[prgSize-3] = 0x10, 0xE0
+	return rom
+}
+
+// iNES格式的testROM，没有NES 2.0的扩展字节，mapper号只有8位
+func inesROM(mapper byte, prgSize, chrSize int, prog []byte) []byte {
+	rom := testROM(uint16(mapper), 0, prgSize, chrSize, prog)
+	rom[7] &^= 0x0C
+	for i := 8; i < 16; i++ {
+		rom[i] = 0
+	}
+	return rom
+}
+
+// 打开背景和方波1，然后死循环
+var loopProg = []byte{
+	0xA9, 0x0A, 0x8D, 0x01, 0x20, // LDA #$0A; STA $2001
+	0xA9, 0x01, 0x8D, 0x15, 0x40, // LDA #$01; STA $4015
+	0xA9, 0xBF, 0x8D, 0x00, 0x40, // LDA #$BF; STA $4000
+	0xA9, 0x80, 0x8D, 0x02, 0x40, // LDA #$80; STA $4002
+	0xA9, 0x08, 0x8D, 0x03, 0x40, // LDA #$08; STA $4003
+	0x4C, 0x29, 0xE0, // JMP $E029
+}
+
+// 死循环
+var idleProg = []byte{0x4C, 0x10, 0xE0} // JMP $E010
+
+func TestStepFrame(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	console.SetAudioSampleRate(44100)
+	start := console.PPU.Frame
+	for i := 0; i < 10; i++ {
+		frame, samples := console.StepFrame()
+		if frame == nil {
+			t.Fatal("nil frame")
+		}
+		// 44100/60.0988 约734个采样
+		if i > 0 && (len(samples) < 733 || len(samples) > 735) {
+			t.Errorf("frame %d: %d samples", i, len(samples))
+		}
+	}
+	if n := console.PPU.Frame - start; n != 10 {
+		t.Errorf("ran %d frames, want 10", n)
+	}
+}
+
+func TestRunFramesDeterministic(t *testing.T) {
+	var frames [2][]byte
+	for i := range frames {
+		console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		inputs := []FrameInput{{}, {Player1: [8]bool{ButtonStart: true}}}
+		if err := console.RunFrames(30, inputs); err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = append([]byte(nil), console.Buffer().Pix...)
+	}
+	if !bytes.Equal(frames[0], frames[1]) {
+		t.Error("same inputs produced different frames")
+	}
+}
+
+// iNES和NES 2.0的同一个ROM: iNES按默认值给8KB PRG RAM，运行结果一样
+func TestINESROM(t *testing.T) {
+	var frames [2][]byte
+	for i, rom := range [][]byte{inesROM(0, 0x4000, 0x2000, loopProg), testROM(0, 0, 0x4000, 0x2000, loopProg)} {
+		console, err := NewConsole(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if card := console.Card; card.NES2 != (i == 1) || card.PRGRAMSize != 0x2000*(1-i) {
+			t.Errorf("rom %d: NES2 = %v, PRG RAM %d", i, card.NES2, card.PRGRAMSize)
+		}
+		if err := console.RunFrames(10, nil); err != nil {
+			t.Fatal(err)
+		}
+		frames[i] = append([]byte(nil), console.Buffer().Pix...)
+	}
+	if !bytes.Equal(frames[0], frames[1]) {
+		t.Error("iNES and NES 2.0 images produced different frames")
+	}
+}
+
+func TestRunFramesJam(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, []byte{0xEA, 0x02}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = console.RunFrames(5, nil)
+	var jam *JamError
+	if !errors.As(err, &jam) || jam.PC != 0xE011 {
+		t.Fatalf("err = %v, want jam at $E011", err)
+	}
+}
+
+// 报告卡死的指令不能读总线，open bus和mapper的状态都保持不变
+func TestJamReport(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, []byte{0xEA, 0x02}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported *JamError
+	console.SetJamCallback(func(err *JamError) {
+		reported = err
+	})
+	for reported == nil && console.PPU.Frame < 2 {
+		console.Step()
+	}
+	if reported == nil || reported.PC != 0xE011 || reported.Opcode != 0x02 {
+		t.Fatalf("callback got %v, want jam at $E011", reported)
+	}
+	mem := console.CPU.Memory.(*CPUMemory)
+	mem.bus = 0x55
+	var jam *JamError
+	if err := console.Err(); !errors.As(err, &jam) || jam.Opcode != 0x02 {
+		t.Errorf("Err() = %v, want jam on opcode $02", err)
+	}
+	if mem.bus != 0x55 {
+		t.Errorf("open bus %02X after Err(), want 55", mem.bus)
+	}
+}
+
+// 快照每2帧一份，每次也要正好倒退要求的帧数
+func TestRewindFrames(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	console.EnableRewind(DefaultRewindInterval, DefaultRewindBudget)
+	if err := console.RunFrames(30, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, frames := range []int{1, 1, 1, 3, 1} {
+		before := console.PPU.Frame
+		if n := console.RewindFrames(frames); n != frames || console.PPU.Frame != before-frames {
+			t.Fatalf("rewind %d from frame %d: returned %d, now at frame %d", frames, before, n, console.PPU.Frame)
+		}
+	}
+	// 倒退之后的状态和直接运行到那一帧一样
+	target := console.PPU.Frame
+	fresh, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for fresh.PPU.Frame < target {
+		fresh.runFrame()
+	}
+	if !bytes.Equal(console.Buffer().Pix, fresh.Buffer().Pix) || console.CPU.Cycles != fresh.CPU.Cycles {
+		t.Error("rewound state differs from a fresh run to the same frame")
+	}
+}
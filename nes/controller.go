@@ -60,3 +60,11 @@ func (c *Controller) Write(value byte) {
 		c.index = 0
 	}
 }
+
+func (c *Controller) serialize(s *Serializer) {
+	for i := range c.buttons {
+		s.Bool(&c.buttons[i])
+	}
+	s.Byte(&c.index)
+	s.Byte(&c.strobe)
+}
@@ -1,9 +1,5 @@
 package nes
 
-import (
-	"fmt"
-)
-
 /*
 CPU模块，对外需要以下接口：
 clock
@@ -36,6 +32,13 @@ const (
 	interruptIRQ
 )
 
+// IRQ来源，IRQ是电平触发的，任一来源请求时CPU都会持续响应，直到来源自己撤销
+const (
+	IRQFrame  byte = 1 << iota // APU帧计数器
+	IRQDMC                     // APU DMC采样结束
+	IRQMapper                  // mapper(MMC3扫描线计数器等)
+)
+
 // 寻址方式
 const (
 	_ = iota
@@ -76,22 +79,22 @@ var instructionModes = [256]byte{
 
 // 每个指令字节大小
 var instructionSizes = [256]byte{
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	3, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	1, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 0, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 0, 3, 0, 0,
-	2, 2, 2, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 2, 1, 0, 3, 3, 3, 0,
-	2, 2, 0, 0, 2, 2, 2, 0, 1, 3, 1, 0, 3, 3, 3, 0,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	3, 2, 1, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	1, 2, 1, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	1, 2, 1, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
+	2, 2, 2, 2, 2, 2, 2, 2, 1, 2, 1, 2, 3, 3, 3, 3,
+	2, 2, 1, 2, 2, 2, 2, 2, 1, 3, 1, 3, 3, 3, 3, 3,
 }
 
 // 指令占用基础周期数，不包括额外的周期
@@ -233,9 +236,43 @@ type CPU struct {
 	U         byte // 未使用
 	V         byte // 溢出标志，计算结果产生溢出
 	N         byte // 负标志，结果为负
-	interrupt byte // 中断type
+	interrupt byte // 下一条指令前要响应的中断
 	table     [256]func(*stepInfo)
-	stall     int // 剩余等待时钟数
+	stall     int  // 剩余等待时钟数
+	jammed    bool // 执行了KIL指令，CPU卡死直到reset
+	onJam     func(pc uint16)
+	tracer    Tracer // 指令跟踪，nil表示关闭
+
+	cycleAccurate bool   // 逐周期模式
+	clock         func() // 逐周期模式下每个CPU时钟调用一次
+	busCycles     uint64 // 当前指令已经走过的时钟数
+
+	nmiLine    bool // PPU的NMI输出电平
+	nmiPending bool // 检测到NMI上升沿，还没有响应
+	irqLines   byte // 各来源的IRQ请求
+	irqMask    byte // 快速模式下最近一次轮询看到的I标志
+
+	// 逐周期模式下每个时钟采样一次中断，指令结束时用倒数第二个时钟的结果
+	poll       byte
+	prevPoll   byte
+	branchPoll byte // 不跨页的分支跳转最后两个时钟都不采样
+	branchSkip bool
+
+	dma oamDMA
+}
+
+/*
+OAM DMA: 写$4014后CPU暂停，把$XX00-$XXFF逐字节读出来写到$2004
+先等1个时钟，在奇数时钟开始时再多等1个，之后读写交替，一共513/514个时钟
+DMA期间DMC取采样只多占2个时钟
+*/
+type oamDMA struct {
+	active  bool
+	address uint16
+	count   int  // 已经复制的字节数
+	wait    int  // 开始前剩余的等待时钟
+	value   byte // 读到还没写入的值
+	loaded  bool
 }
 
 // 指令执行需要的信息
@@ -251,9 +288,75 @@ func (cpu *CPU) Read16(addr uint16) uint16 {
 	return (uint16(high) << 8) | uint16(low)
 }
 
+/*
+逐周期模式下，CPU每次访问总线都占一个时钟，访问前先调用clock让PPU/APU/mapper走一个CPU时钟，
+这样寄存器读写、空读(dummy read)都发生在指令内真实的那个时钟上。
+快速模式下read/write就是普通的读写，整条指令执行完再由console补上时钟。
+*/
+func (cpu *CPU) read(addr uint16) byte {
+	if cpu.cycleAccurate {
+		cpu.tick()
+	}
+	return cpu.Read(addr)
+}
+
+func (cpu *CPU) write(addr uint16, value byte) {
+	if cpu.cycleAccurate {
+		cpu.tick()
+	}
+	cpu.Write(addr, value)
+}
+
+func (cpu *CPU) read16(addr uint16) uint16 {
+	low := cpu.read(addr)
+	high := cpu.read(addr + 1)
+	return (uint16(high) << 8) | uint16(low)
+}
+
+// 硬件上存在但结果被丢弃的读，读寄存器时会有副作用，只在逐周期模式下模拟
+func (cpu *CPU) dummyRead(addr uint16) {
+	if cpu.cycleAccurate {
+		cpu.read(addr)
+	}
+}
+
+// 读-改-写指令写入新值前会先把原值写回一次
+func (cpu *CPU) dummyWrite(addr uint16, value byte) {
+	if cpu.cycleAccurate {
+		cpu.write(addr, value)
+	}
+}
+
+// 变址寻址先用没有进位的高字节读一次，跨页或者写指令时总会多出这一次读
+func (cpu *CPU) indexedDummyRead(opcode byte, base uint16, address uint16) {
+	if cpu.pageDiff(base, address) || instructionPageCycles[opcode] == 0 {
+		cpu.dummyRead(base&0xff00 | address&0xff)
+	}
+}
+
+// 逐周期模式下走一个CPU时钟
+func (cpu *CPU) tick() {
+	cpu.busCycles++
+	if cpu.clock != nil {
+		cpu.clock()
+	}
+	cpu.prevPoll = cpu.poll
+	cpu.poll = cpu.pollInterrupt(cpu.I)
+}
+
+// 开启逐周期模式，clock在每个CPU时钟调用一次
+func (cpu *CPU) SetCycleAccurate(enabled bool, clock func()) {
+	cpu.cycleAccurate = enabled
+	cpu.clock = clock
+}
+
+func (cpu *CPU) CycleAccurate() bool {
+	return cpu.cycleAccurate
+}
+
 // func (cpu *CPU) write16(addr uint16, value uint16) {
-// 	cpu.Write(addr, byte(value&0xff))
-// 	cpu.Write(addr+1, byte(value>>8)&0xff)
+// 	cpu.write(addr, byte(value&0xff))
+// 	cpu.write(addr+1, byte(value>>8)&0xff)
 // }
 
 // 这里模拟cpu的bug，读取16位数据
@@ -261,8 +364,8 @@ func (cpu *CPU) Read16(addr uint16) uint16 {
 func (cpu *CPU) read16bug(address uint16) uint16 {
 	a := address
 	b := (a & 0xFF00) | uint16(byte(a)+1)
-	lo := cpu.Read(a)
-	hi := cpu.Read(b)
+	lo := cpu.read(a)
+	hi := cpu.read(b)
 	return (uint16(hi) << 8) | uint16(lo)
 }
 
@@ -270,7 +373,7 @@ func (cpu *CPU) read16bug(address uint16) uint16 {
 // 压栈 SP指针向0x00靠近
 func (cpu *CPU) push(value byte) {
 	// SP  0x00=0xff 对应真实地址的 0x100-0x1ff
-	cpu.Write(0x100|uint16(cpu.SP), value)
+	cpu.write(0x100|uint16(cpu.SP), value)
 	cpu.SP--
 }
 
@@ -284,7 +387,12 @@ func (cpu *CPU) push16(value uint16) {
 // pop a byte from stack
 func (cpu *CPU) pull() byte {
 	cpu.SP++
-	return cpu.Read(0x100 | uint16(cpu.SP))
+	return cpu.read(0x100 | uint16(cpu.SP))
+}
+
+// 出栈和JSR之前CPU先读一次当前栈顶，SP这时还没有变
+func (cpu *CPU) stackDummyRead() {
+	cpu.dummyRead(0x100 | uint16(cpu.SP))
 }
 
 func (cpu *CPU) pull16() uint16 {
@@ -341,39 +449,91 @@ func (cpu *CPU) setFlags(p byte) {
 	cpu.N = (p >> 7) & 1
 }
 
-// 中断触发相关, 处理irq、nmi中断
-func (cpu *CPU) TriggerIRQ() {
-	if cpu.I == 0 {
-		cpu.interrupt = interruptIRQ
+/*
+中断
+NMI是边沿触发: PPU的NMI输出由低变高时记下一次，响应后清除
+IRQ是电平触发: 多个来源(APU帧计数器/DMC/mapper)各占一位，任一来源请求且I=0时响应
+
+CPU在每条指令倒数第二个时钟检查中断，所以:
+- CLI/SEI/PLP修改I标志后，要再执行一条指令才按新的I判断(RTI立即生效)
+- 不跨页的分支跳转最后两个时钟都不检查，中断会推迟到下一条指令之后
+- BRK/IRQ压栈时出现NMI，会改用NMI的向量(劫持)
+*/
+
+// 设置某个来源的IRQ请求，asserted为false表示撤销
+func (cpu *CPU) SetIRQ(source byte, asserted bool) {
+	if asserted {
+		cpu.irqLines |= source
+	} else {
+		cpu.irqLines &^= source
+	}
+}
+
+// 某个来源是否正在请求IRQ
+func (cpu *CPU) IRQ(source byte) bool {
+	return cpu.irqLines&source != 0
+}
+
+// PPU的NMI输出电平
+func (cpu *CPU) SetNMI(level bool) {
+	if level && !cpu.nmiLine {
+		cpu.nmiPending = true
 	}
+	cpu.nmiLine = level
 }
 
-func (cpu *CPU) TriggerNMI() {
-	cpu.interrupt = interruptNMI
+// 按I标志i判断现在要响应哪个中断
+func (cpu *CPU) pollInterrupt(i byte) byte {
+	if cpu.nmiPending {
+		return interruptNMI
+	}
+	if cpu.irqLines != 0 && i == 0 {
+		return interruptIRQ
+	}
+	return interruptNone
 }
 
-// irq/nmi/brk实现类似
 func (cpu *CPU) irq() {
-	cpu.push16(cpu.PC)
-	cpu.push(cpu.getFlags())
-	cpu.PC = cpu.Read16(IRQ)
-	cpu.I = 1
+	cpu.dummyRead(cpu.PC)
+	cpu.dummyRead(cpu.PC)
+	cpu.interruptSequence(IRQ, cpu.getFlags()&^0x10|0x20)
 	cpu.Cycles += 7
 }
 
 func (cpu *CPU) nmi() {
+	cpu.nmiPending = false
+	cpu.dummyRead(cpu.PC)
+	cpu.dummyRead(cpu.PC)
+	cpu.interruptSequence(NMI, cpu.getFlags()&^0x10|0x20)
+	cpu.Cycles += 7
+}
+
+// irq/nmi/brk共用: 压栈PC和P，从向量读取新的PC
+// 压栈P之前出现NMI时改用NMI的向量，压入的B标志不变
+func (cpu *CPU) interruptSequence(vector uint16, flags byte) {
 	cpu.push16(cpu.PC)
-	cpu.push(cpu.getFlags())
-	cpu.PC = cpu.Read16(NMI)
+	if vector == IRQ && cpu.nmiPending {
+		vector = NMI
+		cpu.nmiPending = false
+	}
+	cpu.push(flags)
 	cpu.I = 1
-	cpu.Cycles += 7
+	cpu.PC = cpu.read16(vector)
 }
 
 // 特殊处理，如果是跨branch（地址跳转），cycle++，如果跨page，cycle再+1
+// 多出的时钟是空读: 先读下一条指令的位置，跨页时再读一次还没修正高字节的地址
 func (cpu *CPU) addBranchCycles(info *stepInfo) {
 	cpu.Cycles++
 	if cpu.pageDiff(info.pc, info.address) {
 		cpu.Cycles++
+		cpu.dummyRead(info.pc)
+		cpu.dummyRead(info.pc&0xff00 | info.address&0xff)
+	} else {
+		// 此时刚走完读操作数的时钟，prevPoll是取指令那个时钟的采样
+		cpu.branchPoll = cpu.prevPoll
+		cpu.branchSkip = true
+		cpu.dummyRead(info.pc)
 	}
 }
 
@@ -383,6 +543,7 @@ func (cpu *CPU) pageDiff(old uint16, new uint16) bool {
 }
 
 func (cpu *CPU) Reset() {
+	cpu.jammed = false
 	cpu.PC = cpu.Read16(RESET)
 	cpu.Cycles = 0
 	cpu.A = 0
@@ -391,40 +552,67 @@ func (cpu *CPU) Reset() {
 	// 栈指针初始化为$FD即指向$1FD
 	cpu.SP = 0xfd
 	cpu.setFlags(0x24)
-}
-
-func LogReg(cpu *CPU) {
-	opcode := cpu.Read(cpu.PC)
-	bytes := instructionSizes[opcode]
-	name := instructionNames[opcode]
-	w0 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+0))
-	w1 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+1))
-	w2 := fmt.Sprintf("%02X", cpu.Read(cpu.PC+2))
-
-	if bytes < 2 {
-		w1 = "  "
-	}
-	if bytes < 3 {
-		w2 = "  "
-	}
-	fmt.Printf(
-		"%4X  %s %s %s  %s %28s"+
-			"A:%02X X:%02X Y:%02X P:%02X SP:%02X CYC:%d\n",
-		cpu.PC, w0, w1, w2, name, "",
-		cpu.A, cpu.X, cpu.Y, cpu.getFlags(), cpu.SP, cpu.Cycles)
+	cpu.interrupt = interruptNone
+	cpu.nmiPending = false
+	cpu.irqMask = cpu.I
+}
+
+func (cpu *CPU) serialize(s *Serializer) {
+	s.Uint64(&cpu.Cycles)
+	s.Uint16(&cpu.PC)
+	s.Byte(&cpu.SP)
+	s.Byte(&cpu.A)
+	s.Byte(&cpu.X)
+	s.Byte(&cpu.Y)
+	flags := cpu.getFlags()
+	s.Byte(&flags)
+	cpu.setFlags(flags)
+	s.Byte(&cpu.interrupt)
+	s.Bool(&cpu.nmiLine)
+	s.Bool(&cpu.nmiPending)
+	s.Byte(&cpu.irqLines)
+	s.Byte(&cpu.irqMask)
+	s.Int(&cpu.stall)
+	s.Bool(&cpu.jammed)
+	s.Bool(&cpu.dma.active)
+	s.Uint16(&cpu.dma.address)
+	s.Int(&cpu.dma.count)
+	s.Int(&cpu.dma.wait)
+	s.Byte(&cpu.dma.value)
+	s.Bool(&cpu.dma.loaded)
 }
 
 // step执行一个指令：读指令-寻址-将数据提供给指令方法执行-计算时钟数
 func (cpu *CPU) Step() int64 {
-	// 日志
-	// LogReg(cpu)
+	cpu.busCycles = 0
 
 	if cpu.stall > 0 {
 		cpu.stall--
+		cpu.Cycles++
+		cpu.idle(1)
+		return 1
+	}
+
+	if cpu.dma.active {
+		cpu.stepDMA()
+		cpu.Cycles++
+		return 1
+	}
+
+	// 卡死后不再取指令也不响应中断，时钟照常走，PPU/APU继续运行
+	if cpu.jammed {
+		cpu.Cycles++
+		cpu.idle(1)
 		return 1
 	}
 
+	lastCycles := cpu.Cycles
+
 	// 处理下中断的情况
+	// 逐周期模式在上一条指令结束时已经判断过，快速模式在这里按上一条指令的I标志判断
+	if !cpu.cycleAccurate {
+		cpu.interrupt = cpu.pollInterrupt(cpu.irqMask)
+	}
 	if cpu.interrupt != interruptNone {
 		if cpu.interrupt == interruptIRQ {
 			cpu.irq()
@@ -434,60 +622,81 @@ func (cpu *CPU) Step() int64 {
 		cpu.interrupt = interruptNone
 	}
 
+	if cpu.tracer != nil {
+		cpu.tracer.Trace(cpu)
+	}
+
 	// 初始1byte必定是opcode
-	opcode := cpu.Read(cpu.PC)
+	opcode := cpu.read(cpu.PC)
 	mode := instructionModes[opcode]
-	lastCycles := cpu.Cycles
 
 	var address uint16
 	var pageCrossed bool
 
 	// 参考这里： https://github.com/dustpg/BlogFM/issues/9
+	// 逐周期模式下按真实的顺序读操作数，包括各种空读
 	switch mode {
 	case modeAbsolute:
-		address = cpu.Read16(cpu.PC + 1)
+		if opcode == 0x20 {
+			// JSR压栈之后才读目标地址的高字节，这里先只读低字节
+			address = uint16(cpu.read(cpu.PC + 1))
+		} else {
+			address = cpu.read16(cpu.PC + 1)
+		}
 	case modeAbsoluteX:
-		address = cpu.Read16(cpu.PC+1) + uint16(cpu.X)
-		pageCrossed = cpu.pageDiff(address-uint16(cpu.X), address)
+		base := cpu.read16(cpu.PC + 1)
+		address = base + uint16(cpu.X)
+		pageCrossed = cpu.pageDiff(base, address)
+		cpu.indexedDummyRead(opcode, base, address)
 	case modeAbsoluteY:
-		address = cpu.Read16(cpu.PC+1) + uint16(cpu.Y)
-		pageCrossed = cpu.pageDiff(address-uint16(cpu.Y), address)
+		base := cpu.read16(cpu.PC + 1)
+		address = base + uint16(cpu.Y)
+		pageCrossed = cpu.pageDiff(base, address)
+		cpu.indexedDummyRead(opcode, base, address)
 	case modeAccumulator:
 		// cpu.A = cpu.A >> 1
 		// 无需地址置0
 		address = 0
+		cpu.dummyRead(cpu.PC + 1)
 	case modeImmediate:
 		address = cpu.PC + 1
 	case modeImplied:
 		// cpu.X = cpu.A
 		address = 0
+		cpu.dummyRead(cpu.PC + 1)
 	// 变址间接寻址
 	case modeIndexedIndirect:
 		// 将指令的数据 + X 结果作为地址去获取数据作为新地址
-		address = cpu.read16bug(uint16(cpu.Read(cpu.PC+1) + cpu.X))
+		ptr := cpu.read(cpu.PC + 1)
+		cpu.dummyRead(uint16(ptr))
+		address = cpu.read16bug(uint16(ptr + cpu.X))
 	// 间接寻址
 	case modeIndirect:
-		address = cpu.read16bug(cpu.Read16(cpu.PC + 1))
+		address = cpu.read16bug(cpu.read16(cpu.PC + 1))
 	// 间接变址寻址
 	case modeIndirectIndexed:
-		address = cpu.read16bug(uint16(cpu.Read(cpu.PC+1))) + uint16(cpu.Y)
-		pageCrossed = cpu.pageDiff(address-uint16(cpu.Y), address)
+		base := cpu.read16bug(uint16(cpu.read(cpu.PC + 1)))
+		address = base + uint16(cpu.Y)
+		pageCrossed = cpu.pageDiff(base, address)
+		cpu.indexedDummyRead(opcode, base, address)
 	// 相对寻址
 	case modeRelative:
-		offset := uint16(cpu.Read(cpu.PC + 1))
+		offset := uint16(cpu.read(cpu.PC + 1))
 		if offset < 0x80 {
 			address = cpu.PC + 2 + offset
 		} else {
 			address = cpu.PC + 2 + offset - 0x100
 		}
 	case modeZeroPage:
-		address = uint16(cpu.Read(cpu.PC+1)) & 0xff
+		address = uint16(cpu.read(cpu.PC+1)) & 0xff
 	case modeZeroPageX:
-		address = uint16(cpu.Read(cpu.PC+1) + cpu.X)
-		address = address & 0xff
+		base := cpu.read(cpu.PC + 1)
+		cpu.dummyRead(uint16(base))
+		address = uint16(base+cpu.X) & 0xff
 	case modeZeroPageY:
-		address = uint16(cpu.Read(cpu.PC+1) + cpu.Y)
-		address = address & 0xff
+		base := cpu.read(cpu.PC + 1)
+		cpu.dummyRead(uint16(base))
+		address = uint16(base+cpu.Y) & 0xff
 	default:
 		panic("unknown address mode.")
 	}
@@ -506,52 +715,84 @@ func (cpu *CPU) Step() int64 {
 
 	info := &stepInfo{address, cpu.PC, mode}
 
+	i := cpu.I
+	cpu.branchSkip = false
 	cpu.table[opcode](info)
 
-	return int64(cpu.Cycles - lastCycles)
+	// 6502每个时钟都访问总线，内部运算的时钟也是空读，都已经在指令里按真实的位置走过了
+	cycles := cpu.Cycles - lastCycles
+
+	if cpu.cycleAccurate {
+		cpu.interrupt = cpu.prevPoll
+		if cpu.branchSkip {
+			cpu.interrupt = cpu.branchPoll
+		}
+	} else {
+		// CLI/SEI/PLP在最后一个时钟才修改I，这次轮询看到的还是原来的值
+		switch opcode {
+		case 0x58, 0x78, 0x28:
+			cpu.irqMask = i
+		default:
+			cpu.irqMask = cpu.I
+		}
+	}
+	return int64(cycles)
+}
+
+// 逐周期模式下把时钟补齐到cycles，只用于DMA等待、DMC暂停和卡死，这些时候CPU不访问总线
+func (cpu *CPU) idle(cycles uint64) {
+	if !cpu.cycleAccurate {
+		return
+	}
+	for cpu.busCycles < cycles {
+		cpu.tick()
+	}
 }
 
 // LDA - load "A"
 func (cpu *CPU) lda(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.A = value
 	cpu.setZN(value)
 }
 
 // LDX - load "X"
 func (cpu *CPU) ldx(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.X = value
 	cpu.setZN(value)
 }
 
 // LDY - load "Y"
 func (cpu *CPU) ldy(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.Y = value
 	cpu.setZN(value)
 }
 
 // STA - store "A"
 func (cpu *CPU) sta(info *stepInfo) {
-	cpu.Write(info.address, cpu.A)
+	cpu.write(info.address, cpu.A)
 }
 
 // STX - store "X"
 func (cpu *CPU) stx(info *stepInfo) {
-	cpu.Write(info.address, cpu.X)
+	cpu.write(info.address, cpu.X)
 }
 
 // STY - store "Y"
 func (cpu *CPU) sty(info *stepInfo) {
-	cpu.Write(info.address, cpu.Y)
+	cpu.write(info.address, cpu.Y)
 }
 
 // 这个自己实现错了，使用了参考项目的代码
 // ADC - add with carry -- A = A + M + C
 func (cpu *CPU) adc(info *stepInfo) {
+	cpu.addWithCarry(cpu.read(info.address))
+}
+
+func (cpu *CPU) addWithCarry(b byte) {
 	a := cpu.A
-	b := cpu.Read(info.address)
 	c := cpu.C
 	cpu.A = a + b + c
 	cpu.setZN(cpu.A)
@@ -569,8 +810,11 @@ func (cpu *CPU) adc(info *stepInfo) {
 
 // SBC - subtract with carry -- A = A - M - (1 - C)
 func (cpu *CPU) sbc(info *stepInfo) {
+	cpu.subWithCarry(cpu.read(info.address))
+}
+
+func (cpu *CPU) subWithCarry(b byte) {
 	a := cpu.A
-	b := cpu.Read(info.address)
 	c := cpu.C
 	cpu.A = a - b - (1 - c)
 	cpu.setZN(cpu.A)
@@ -591,35 +835,37 @@ func (cpu *CPU) sbc(info *stepInfo) {
 
 // INC - Increment memory
 func (cpu *CPU) inc(info *stepInfo) {
-	value := cpu.Read(info.address)
-	cpu.Write(info.address, value+1)
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.write(info.address, value+1)
 	cpu.setZN(value + 1)
 }
 
 // DEC - Decrement memory
 func (cpu *CPU) dec(info *stepInfo) {
-	value := cpu.Read(info.address)
-	cpu.Write(info.address, value-1)
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.write(info.address, value-1)
 	cpu.setZN(value - 1)
 }
 
 // AND - A & memory
 func (cpu *CPU) and(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.A = cpu.A & value
 	cpu.setZN(cpu.A)
 }
 
 // ORA - A | memory
 func (cpu *CPU) ora(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.A |= value
 	cpu.setZN(cpu.A)
 }
 
 // EOR "Exclusive-Or" memory with A
 func (cpu *CPU) eor(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.A ^= value
 	cpu.setZN(cpu.A)
 }
@@ -729,7 +975,7 @@ func (cpu *CPU) compare(a, b byte) {
 
 // CMP - Compare memory with A
 func (cpu *CPU) cmp(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	// if int(cpu.A)-int(value) < 0x100 {
 	// 	cpu.C = 1
 	// } else {
@@ -741,7 +987,7 @@ func (cpu *CPU) cmp(info *stepInfo) {
 
 // CPX - Compare memory with X
 func (cpu *CPU) cpx(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	// if int(cpu.X)-int(value) < 0x100 {
 	// 	cpu.C = 1
 	// } else {
@@ -753,7 +999,7 @@ func (cpu *CPU) cpx(info *stepInfo) {
 
 // CPY - Compare memory with Y
 func (cpu *CPU) cpy(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	// if int(cpu.Y)-int(value) < 0x100 {
 	// 	cpu.C = 1
 	// } else {
@@ -765,7 +1011,7 @@ func (cpu *CPU) cpy(info *stepInfo) {
 
 // BIT - Bit test memory with A
 func (cpu *CPU) bit(info *stepInfo) {
-	value := cpu.Read(info.address)
+	value := cpu.read(info.address)
 	cpu.setZ(cpu.A & value)
 	cpu.V = (value >> 6) & 1
 	cpu.N = (value >> 7) & 1
@@ -778,10 +1024,11 @@ func (cpu *CPU) asl(info *stepInfo) {
 		cpu.A <<= 1
 		cpu.setZN(cpu.A)
 	} else {
-		value := cpu.Read(info.address)
+		value := cpu.read(info.address)
+		cpu.dummyWrite(info.address, value)
 		cpu.C = (value >> 7) & 1
 		value <<= 1
-		cpu.Write(info.address, value)
+		cpu.write(info.address, value)
 		cpu.setZN(value)
 	}
 }
@@ -793,10 +1040,11 @@ func (cpu *CPU) lsr(info *stepInfo) {
 		cpu.A >>= 1
 		cpu.setZN(cpu.A)
 	} else {
-		value := cpu.Read(info.address)
+		value := cpu.read(info.address)
+		cpu.dummyWrite(info.address, value)
 		cpu.C = value & 1
 		value >>= 1
-		cpu.Write(info.address, value)
+		cpu.write(info.address, value)
 		cpu.setZN(value)
 	}
 }
@@ -810,11 +1058,12 @@ func (cpu *CPU) rol(info *stepInfo) {
 		cpu.setZN(cpu.A)
 	} else {
 		c := cpu.C
-		value := cpu.Read(info.address)
+		value := cpu.read(info.address)
+		cpu.dummyWrite(info.address, value)
 		cpu.C = (value >> 7) & 1
 		value = (value << 1) | c
 		cpu.setZN(value)
-		cpu.Write(info.address, value)
+		cpu.write(info.address, value)
 	}
 }
 
@@ -827,11 +1076,12 @@ func (cpu *CPU) ror(info *stepInfo) {
 		cpu.setZN(cpu.A)
 	} else {
 		c := cpu.C
-		value := cpu.Read(info.address)
+		value := cpu.read(info.address)
+		cpu.dummyWrite(info.address, value)
 		cpu.C = value & 1
 		value = (value >> 1) | (c << 7)
 		cpu.setZN(value)
-		cpu.Write(info.address, value)
+		cpu.write(info.address, value)
 	}
 }
 
@@ -842,17 +1092,20 @@ func (cpu *CPU) pha(info *stepInfo) {
 
 // PLA - Pull(Pop) A
 func (cpu *CPU) pla(info *stepInfo) {
+	cpu.stackDummyRead()
 	cpu.A = cpu.pull()
 	cpu.setZN(cpu.A)
 }
 
 // PHP - Push Processor-status
 func (cpu *CPU) php(info *stepInfo) {
-	cpu.push(cpu.getFlags())
+	// PHP/BRK压栈时B位为1，硬件中断压栈时B位为0
+	cpu.push(cpu.getFlags() | 0x30)
 }
 
 // PLP - Pull Processor-status
 func (cpu *CPU) plp(info *stepInfo) {
+	cpu.stackDummyRead()
 	cpu.setFlags(cpu.pull()&0xef | 0x20)
 }
 
@@ -926,71 +1179,260 @@ func (cpu *CPU) bvc(info *stepInfo) {
 }
 
 // JSR - Jump to Subroutine
+// 读完低字节后空读一次栈，压栈返回地址，最后才读高字节
 func (cpu *CPU) jsr(info *stepInfo) {
+	cpu.stackDummyRead()
 	cpu.push16(cpu.PC - 1)
-	cpu.PC = info.address
+	high := cpu.read(cpu.PC - 1)
+	cpu.PC = uint16(high)<<8 | info.address
 }
 
 // RTS - Return from Subroutine
+// 出栈之后还要空读一次返回地址，再加1
 func (cpu *CPU) rts(info *stepInfo) {
-	cpu.PC = cpu.pull16() + 1
+	cpu.stackDummyRead()
+	cpu.PC = cpu.pull16()
+	cpu.dummyRead(cpu.PC)
+	cpu.PC++
 }
 
 // NOP - do nothing... 哈？
-func (cpu *CPU) nop(info *stepInfo) {}
+// 带操作数的非官方NOP和对应寻址方式的读指令一样会读一次
+func (cpu *CPU) nop(info *stepInfo) {
+	if info.mode != modeImplied {
+		cpu.dummyRead(info.address)
+	}
+}
 
 // BRK 强制中断
 func (cpu *CPU) brk(info *stepInfo) {
-	cpu.push(byte(cpu.PC >> 8))
-	cpu.push(byte(cpu.PC) & 0xff)
-	cpu.push(cpu.getFlags())
-	cpu.PC = cpu.Read16(IRQ)
+	cpu.interruptSequence(IRQ, cpu.getFlags()|0x30)
 }
 
 // RTI - Return from Interrupt
 func (cpu *CPU) rti(info *stepInfo) {
-	cpu.setFlags(cpu.pull())
+	cpu.stackDummyRead()
+	cpu.setFlags(cpu.pull()&0xef | 0x20)
 	cpu.PC = cpu.pull16()
 }
 
-// 以下指令未实现
-func (cpu *CPU) kil(info *stepInfo) {}
+// KIL - CPU卡死，PC停在这条指令上，只有reset能恢复
+func (cpu *CPU) kil(info *stepInfo) {
+	cpu.PC = info.pc - 1
+	cpu.jammed = true
+	if cpu.onJam != nil {
+		cpu.onJam(cpu.PC)
+	}
+}
 
-func (cpu *CPU) slo(info *stepInfo) {}
+// 写$4014时开始OAM DMA，page是源地址的高字节
+func (cpu *CPU) startOAMDMA(page byte) {
+	cpu.dma = oamDMA{active: true, address: uint16(page) << 8, wait: 1}
+	if cpu.Cycles%2 == 1 {
+		cpu.dma.wait++
+	}
+}
 
-func (cpu *CPU) anc(info *stepInfo) {}
+// DMA的一个时钟，读写都走总线
+func (cpu *CPU) stepDMA() {
+	d := &cpu.dma
+	switch {
+	case d.wait > 0:
+		d.wait--
+		cpu.idle(1)
+	case !d.loaded:
+		d.value = cpu.read(d.address)
+		d.address++
+		d.loaded = true
+	default:
+		cpu.write(0x2004, d.value)
+		d.loaded = false
+		d.count++
+		d.active = d.count < 256
+	}
+}
 
-func (cpu *CPU) sre(info *stepInfo) {}
+// DMC取采样时占用总线，CPU暂停4个时钟，OAM DMA进行中时只多占2个
+func (cpu *CPU) dmcRead(addr uint16) byte {
+	if cpu.dma.active {
+		cpu.stall += 2
+	} else {
+		cpu.stall += 4
+	}
+	return cpu.Read(addr)
+}
 
-func (cpu *CPU) sax(info *stepInfo) {}
+// CPU是否卡死，卡死时PC就是KIL指令的地址
+func (cpu *CPU) Jammed() bool {
+	return cpu.jammed
+}
 
-func (cpu *CPU) rla(info *stepInfo) {}
+/*
+以下是非官方指令，参考 https://wiki.nesdev.org/w/index.php/CPU_unofficial_opcodes
+大部分是两条官方指令的组合，读-改-写类的指令和官方的一样会先写回原值
+*/
 
-func (cpu *CPU) alr(info *stepInfo) {}
+// SLO - ASL memory, then ORA
+func (cpu *CPU) slo(info *stepInfo) {
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.C = (value >> 7) & 1
+	value <<= 1
+	cpu.write(info.address, value)
+	cpu.A |= value
+	cpu.setZN(cpu.A)
+}
 
-func (cpu *CPU) rra(info *stepInfo) {}
+// RLA - ROL memory, then AND
+func (cpu *CPU) rla(info *stepInfo) {
+	c := cpu.C
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.C = (value >> 7) & 1
+	value = (value << 1) | c
+	cpu.write(info.address, value)
+	cpu.A &= value
+	cpu.setZN(cpu.A)
+}
 
-func (cpu *CPU) arr(info *stepInfo) {}
+// SRE - LSR memory, then EOR
+func (cpu *CPU) sre(info *stepInfo) {
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.C = value & 1
+	value >>= 1
+	cpu.write(info.address, value)
+	cpu.A ^= value
+	cpu.setZN(cpu.A)
+}
+
+// RRA - ROR memory, then ADC
+func (cpu *CPU) rra(info *stepInfo) {
+	c := cpu.C
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	cpu.C = value & 1
+	value = (value >> 1) | (c << 7)
+	cpu.write(info.address, value)
+	cpu.addWithCarry(value)
+}
+
+// SAX - store A & X
+func (cpu *CPU) sax(info *stepInfo) {
+	cpu.write(info.address, cpu.A&cpu.X)
+}
+
+// LAX - LDA + LDX
+// 立即数版本(0xAB)不稳定，按通用做法 A = X = (A | 0xEE) & M
+func (cpu *CPU) lax(info *stepInfo) {
+	value := cpu.read(info.address)
+	if info.mode == modeImmediate {
+		value &= cpu.A | 0xEE
+	}
+	cpu.A = value
+	cpu.X = value
+	cpu.setZN(value)
+}
+
+// DCP - DEC memory, then CMP
+func (cpu *CPU) dcp(info *stepInfo) {
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	value--
+	cpu.write(info.address, value)
+	cpu.compare(cpu.A, value)
+}
+
+// ISC - INC memory, then SBC
+func (cpu *CPU) isc(info *stepInfo) {
+	value := cpu.read(info.address)
+	cpu.dummyWrite(info.address, value)
+	value++
+	cpu.write(info.address, value)
+	cpu.subWithCarry(value)
+}
+
+// ANC - AND, 然后把N复制到C
+func (cpu *CPU) anc(info *stepInfo) {
+	cpu.A &= cpu.read(info.address)
+	cpu.setZN(cpu.A)
+	cpu.C = cpu.N
+}
 
-func (cpu *CPU) xaa(info *stepInfo) {}
+// ALR - AND, 然后 LSR A
+func (cpu *CPU) alr(info *stepInfo) {
+	cpu.A &= cpu.read(info.address)
+	cpu.C = cpu.A & 1
+	cpu.A >>= 1
+	cpu.setZN(cpu.A)
+}
 
-func (cpu *CPU) ahx(info *stepInfo) {}
+// ARR - AND, 然后 ROR A，C取结果的bit 6，V取bit 6 ^ bit 5
+func (cpu *CPU) arr(info *stepInfo) {
+	cpu.A &= cpu.read(info.address)
+	cpu.A = (cpu.A >> 1) | (cpu.C << 7)
+	cpu.setZN(cpu.A)
+	cpu.C = (cpu.A >> 6) & 1
+	cpu.V = cpu.C ^ ((cpu.A >> 5) & 1)
+}
 
-func (cpu *CPU) shx(info *stepInfo) {}
+// AXS - X = (A & X) - M，按CMP设置标志位
+func (cpu *CPU) axs(info *stepInfo) {
+	value := cpu.read(info.address)
+	ax := cpu.A & cpu.X
+	cpu.compare(ax, value)
+	cpu.X = ax - value
+}
 
-func (cpu *CPU) shy(info *stepInfo) {}
+// LAS - A = X = SP = M & SP
+func (cpu *CPU) las(info *stepInfo) {
+	value := cpu.read(info.address) & cpu.SP
+	cpu.A = value
+	cpu.X = value
+	cpu.SP = value
+	cpu.setZN(value)
+}
 
-func (cpu *CPU) tas(info *stepInfo) {}
+// XAA - 不稳定，按通用做法 A = (A | 0xEE) & X & M
+func (cpu *CPU) xaa(info *stepInfo) {
+	cpu.A = (cpu.A | 0xEE) & cpu.X & cpu.read(info.address)
+	cpu.setZN(cpu.A)
+}
 
-func (cpu *CPU) lax(info *stepInfo) {}
+/*
+AHX/SHX/SHY/TAS 写入 value & (基址高字节 + 1)
+跨页时地址的高字节会被写入的值替换
+*/
+func (cpu *CPU) storeHigh(info *stepInfo, index byte, value byte) {
+	base := info.address - uint16(index)
+	value &= byte(base>>8) + 1
+	address := info.address
+	if cpu.pageDiff(base, address) {
+		address = uint16(value)<<8 | address&0xff
+	}
+	cpu.write(address, value)
+}
 
-func (cpu *CPU) las(info *stepInfo) {}
+// AHX - 写入 A & X & (H + 1)
+func (cpu *CPU) ahx(info *stepInfo) {
+	cpu.storeHigh(info, cpu.Y, cpu.A&cpu.X)
+}
 
-func (cpu *CPU) dcp(info *stepInfo) {}
+// SHX - 写入 X & (H + 1)
+func (cpu *CPU) shx(info *stepInfo) {
+	cpu.storeHigh(info, cpu.Y, cpu.X)
+}
 
-func (cpu *CPU) isc(info *stepInfo) {}
+// SHY - 写入 Y & (H + 1)
+func (cpu *CPU) shy(info *stepInfo) {
+	cpu.storeHigh(info, cpu.X, cpu.Y)
+}
 
-func (cpu *CPU) axs(info *stepInfo) {}
+// TAS - SP = A & X，然后写入 SP & (H + 1)
+func (cpu *CPU) tas(info *stepInfo) {
+	cpu.SP = cpu.A & cpu.X
+	cpu.storeHigh(info, cpu.Y, cpu.SP)
+}
 
 /*
 https://www.jianshu.com/p/ba75b1186ecd
@@ -0,0 +1,442 @@
+package nes
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/*
+单条指令测试，使用社区的per-opcode JSON格式(SingleStepTests/ProcessorTests nes6502):
+每个文件是一个数组，每项给出执行前后的寄存器和内存，cycles是每个时钟的总线访问(地址, 值, 读/写)，
+逐周期模式下要求每个时钟的访问都一致
+
+testdata/cpu 下是仓库自带的用例，每个opcode一个文件(如a9.json)，由独立的参考模型 gen6502.py 生成，
+256个opcode都必须有用例
+上游的完整用例集放到 testdata/nes6502/v1，不存在时跳过
+*/
+
+const (
+	cpuSampleDir = "testdata/cpu"
+	cpuSuiteDir  = "testdata/nes6502/v1"
+)
+
+// 平坦的64KB内存，没有镜像和寄存器
+type testMemory [0x10000]byte
+
+func (mem *testMemory) Read(addr uint16) byte {
+	return mem[addr]
+}
+
+func (mem *testMemory) Write(addr uint16, value byte) {
+	mem[addr] = value
+}
+
+// 一个时钟的总线访问，JSON里是 [地址, 值, "read"/"write"]
+type busCycle struct {
+	Addr  uint16
+	Value byte
+	Write bool
+}
+
+func (c *busCycle) UnmarshalJSON(data []byte) error {
+	var raw [3]interface{}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	addr, ok1 := raw[0].(float64)
+	value, ok2 := raw[1].(float64)
+	kind, ok3 := raw[2].(string)
+	if !ok1 || !ok2 || !ok3 || (kind != "read" && kind != "write") {
+		return fmt.Errorf("bad cycle %s", data)
+	}
+	*c = busCycle{uint16(addr), byte(value), kind == "write"}
+	return nil
+}
+
+func (c busCycle) String() string {
+	kind := "read"
+	if c.Write {
+		kind = "write"
+	}
+	return fmt.Sprintf("%04X %02X %s", c.Addr, c.Value, kind)
+}
+
+// 记下每次总线访问的内存
+type recordingMemory struct {
+	*testMemory
+	cycles []busCycle
+}
+
+func (mem *recordingMemory) Read(addr uint16) byte {
+	value := mem.testMemory.Read(addr)
+	mem.cycles = append(mem.cycles, busCycle{addr, value, false})
+	return value
+}
+
+func (mem *recordingMemory) Write(addr uint16, value byte) {
+	mem.cycles = append(mem.cycles, busCycle{addr, value, true})
+	mem.testMemory.Write(addr, value)
+}
+
+type cpuTestState struct {
+	PC  uint16   `json:"pc"`
+	S   byte     `json:"s"`
+	A   byte     `json:"a"`
+	X   byte     `json:"x"`
+	Y   byte     `json:"y"`
+	P   byte     `json:"p"`
+	RAM [][2]int `json:"ram"`
+}
+
+type cpuTestCase struct {
+	Name    string       `json:"name"`
+	Initial cpuTestState `json:"initial"`
+	Final   cpuTestState `json:"final"`
+	Cycles  []busCycle   `json:"cycles"`
+}
+
+func (tc *cpuTestCase) opcode() (byte, bool) {
+	for _, cell := range tc.Initial.RAM {
+		if cell[0] == int(tc.Initial.PC) {
+			return byte(cell[1]), true
+		}
+	}
+	return 0, false
+}
+
+func newTestCPU(mem Memory) *CPU {
+	cpu := &CPU{Memory: mem}
+	cpu.createTable()
+	return cpu
+}
+
+// 执行一条指令，返回和期望结果不一致的地方
+// 逐周期模式下还要逐个时钟检查总线访问，快速模式不做空读，只比较结果
+func runCPUTest(tc *cpuTestCase, cycleAccurate bool) error {
+	mem := &testMemory{}
+	for _, cell := range tc.Initial.RAM {
+		mem[cell[0]] = byte(cell[1])
+	}
+	bus := &recordingMemory{testMemory: mem}
+	cpu := newTestCPU(bus)
+	clocks := 0
+	cpu.SetCycleAccurate(cycleAccurate, func() {
+		clocks++
+	})
+	cpu.PC = tc.Initial.PC
+	cpu.SP = tc.Initial.S
+	cpu.A = tc.Initial.A
+	cpu.X = tc.Initial.X
+	cpu.Y = tc.Initial.Y
+	cpu.setFlags(tc.Initial.P)
+
+	cycles := cpu.Step()
+
+	var diffs []string
+	check := func(name string, got, want int) {
+		if got != want {
+			diffs = append(diffs, fmt.Sprintf("%s=%02X want %02X", name, got, want))
+		}
+	}
+	check("PC", int(cpu.PC), int(tc.Final.PC))
+	check("S", int(cpu.SP), int(tc.Final.S))
+	check("A", int(cpu.A), int(tc.Final.A))
+	check("X", int(cpu.X), int(tc.Final.X))
+	check("Y", int(cpu.Y), int(tc.Final.Y))
+	// B和U在寄存器里并不存在，只比较其他位
+	check("P", int(cpu.getFlags()&^0x30), int(tc.Final.P&^0x30))
+	check("cycles", int(cycles), len(tc.Cycles))
+	if cycleAccurate {
+		check("clocks", clocks, len(tc.Cycles))
+		for i, want := range tc.Cycles {
+			if i >= len(bus.cycles) {
+				diffs = append(diffs, fmt.Sprintf("cycle %d missing, want %v", i+1, want))
+				break
+			}
+			// 每个时钟正好一次访问，clock在访问前调用
+			if got := bus.cycles[i]; got != want {
+				diffs = append(diffs, fmt.Sprintf("cycle %d: %v want %v", i+1, got, want))
+				break
+			}
+		}
+		if len(bus.cycles) > len(tc.Cycles) {
+			diffs = append(diffs, fmt.Sprintf("%d extra bus accesses", len(bus.cycles)-len(tc.Cycles)))
+		}
+	}
+	for _, cell := range tc.Final.RAM {
+		check(fmt.Sprintf("[%04X]", cell[0]), int(mem[cell[0]]), cell[1])
+	}
+	if len(diffs) > 0 {
+		return fmt.Errorf("%s", strings.Join(diffs, " "))
+	}
+	return nil
+}
+
+// KIL之后CPU停住不再访问总线，和真机不一样，只检查是否卡死在这条指令上
+func runJamTest(tc *cpuTestCase) error {
+	mem := &testMemory{}
+	for _, cell := range tc.Initial.RAM {
+		mem[cell[0]] = byte(cell[1])
+	}
+	cpu := newTestCPU(mem)
+	cpu.PC = tc.Initial.PC
+	cpu.Step()
+	if !cpu.Jammed() || cpu.PC != tc.Initial.PC {
+		return fmt.Errorf("jammed=%v PC=%04X, want jammed at %04X", cpu.Jammed(), cpu.PC, tc.Initial.PC)
+	}
+	return nil
+}
+
+func loadCPUTests(path string) ([]cpuTestCase, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cases []cpuTestCase
+	if err := json.Unmarshal(data, &cases); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return cases, nil
+}
+
+// 跑完dir下所有用例，返回覆盖到的opcode
+func runCPUTestDir(t *testing.T, dir string, limit int) map[byte]bool {
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	covered := map[byte]bool{}
+	for _, file := range files {
+		cases, err := loadCPUTests(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if limit > 0 && len(cases) > limit {
+			cases = cases[:limit]
+		}
+		failed := 0
+		for i := range cases {
+			tc := &cases[i]
+			opcode, ok := tc.opcode()
+			if !ok {
+				t.Fatalf("%s: %q has no opcode at pc", file, tc.Name)
+			}
+			covered[opcode] = true
+			var err error
+			if instructionNames[opcode] == "KIL" {
+				err = runJamTest(tc)
+			} else if err = runCPUTest(tc, false); err == nil {
+				err = runCPUTest(tc, true)
+			}
+			if err != nil {
+				t.Errorf("%s %q (%s): %v", filepath.Base(file), tc.Name, instructionNames[opcode], err)
+				// 一个opcode出错时通常大部分用例都会错，只报前几个
+				if failed++; failed >= 5 {
+					break
+				}
+			}
+		}
+	}
+	return covered
+}
+
+// createTable里的每个opcode都要有用例
+func checkCPUCoverage(t *testing.T, dir string, covered map[byte]bool) {
+	for opcode := 0; opcode < 256; opcode++ {
+		if !covered[byte(opcode)] {
+			t.Errorf("%s: opcode %02X (%s) has no test cases", dir, opcode, instructionNames[opcode])
+		}
+	}
+}
+
+func TestCPUOpcodes(t *testing.T) {
+	covered := runCPUTestDir(t, cpuSampleDir, 0)
+	checkCPUCoverage(t, cpuSampleDir, covered)
+}
+
+func TestCPUSuite(t *testing.T) {
+	if _, err := os.Stat(cpuSuiteDir); os.IsNotExist(err) {
+		t.Skipf("%s not found, see testdata/README.md", cpuSuiteDir)
+	}
+	limit := 0
+	if testing.Short() {
+		limit = 100
+	}
+	covered := runCPUTestDir(t, cpuSuiteDir, limit)
+	checkCPUCoverage(t, cpuSuiteDir, covered)
+}
+
+// 从$8000执行prog，IRQ向量$9000，NMI向量$A000，返回每条指令后的PC
+func runInterruptTest(cycleAccurate bool, prog []byte, flags byte, steps int, clock func(cpu *CPU, n int)) []uint16 {
+	mem := &testMemory{}
+	copy(mem[0x8000:], prog)
+	mem[0xFFFE], mem[0xFFFF] = 0x00, 0x90
+	mem[0xFFFA], mem[0xFFFB] = 0x00, 0xA0
+	mem[0x9000], mem[0xA000] = 0xEA, 0xEA
+	cpu := newTestCPU(mem)
+	n := 0
+	cpu.SetCycleAccurate(cycleAccurate, func() {
+		n++
+		if clock != nil {
+			clock(cpu, n)
+		}
+	})
+	cpu.PC = 0x8000
+	cpu.SP = 0xfd
+	cpu.setFlags(flags)
+	cpu.irqMask = cpu.I
+	cpu.SetIRQ(IRQMapper, flags&0x04 != 0)
+	var pcs []uint16
+	for i := 0; i < steps; i++ {
+		cpu.Step()
+		pcs = append(pcs, cpu.PC)
+	}
+	return pcs
+}
+
+// 第n个时钟拉起IRQ
+func irqAt(at int) func(cpu *CPU, n int) {
+	return func(cpu *CPU, n int) {
+		if n == at {
+			cpu.SetIRQ(IRQFrame, true)
+		}
+	}
+}
+
+// JMP到$80FD，BNE跳过一个字节到$8100，跨页
+func pageCrossBranchProg() []byte {
+	prog := make([]byte, 0x101)
+	copy(prog, []byte{0x4C, 0xFD, 0x80})
+	copy(prog[0xFD:], []byte{0xD0, 0x01, 0xEA, 0xEA})
+	return prog
+}
+
+/*
+中断延迟，对应blargg cpu_interrupts_v2的几个单项(rom不在仓库里):
+CLI/SEI/PLP改I标志要晚一条指令生效，RTI立即生效，
+不跨页的分支跳转推迟IRQ，跨页的不推迟，NMI和IRQ同时出现时走NMI，BRK可以被NMI劫持
+*/
+func TestInterruptTiming(t *testing.T) {
+	tests := []struct {
+		name  string
+		cycle bool
+		prog  []byte
+		flags byte
+		clock func(cpu *CPU, n int)
+		want  []uint16
+	}{
+		// CLI之后还要再执行一条指令才响应IRQ
+		{"cli", false, []byte{0x58, 0xEA, 0xEA}, 0x24, nil, []uint16{0x8001, 0x8002, 0x9001}},
+		{"cli cycle", true, []byte{0x58, 0xEA, 0xEA}, 0x24, nil, []uint16{0x8001, 0x8002, 0x9001}},
+		// 不跨页的分支跳转最后两个时钟出现的IRQ推迟到下一条指令之后
+		{"branch", true, []byte{0xD0, 0x00, 0xEA, 0xEA}, 0x20, func(cpu *CPU, n int) {
+			if n == 2 {
+				cpu.SetIRQ(IRQFrame, true)
+			}
+		}, []uint16{0x8002, 0x8003, 0x9001}},
+		// 跨页时第3个时钟出现的IRQ在分支之后马上响应，最后一个时钟出现的才推迟
+		{"page cross branch", true, pageCrossBranchProg(), 0x20, irqAt(6), []uint16{0x80FD, 0x8100, 0x9001}},
+		{"page cross branch late", true, pageCrossBranchProg(), 0x20, irqAt(7), []uint16{0x80FD, 0x8100, 0x8101}},
+		// SEI之前的IRQ在SEI之后还会响应一次
+		{"sei", true, []byte{0x78, 0xEA, 0xEA}, 0x20, irqAt(1), []uint16{0x8001, 0x9001}},
+		// PLP设置I同SEI，清除I同CLI
+		{"plp set", true, []byte{0xA9, 0x24, 0x48, 0x28, 0xEA}, 0x20, irqAt(6), []uint16{0x8002, 0x8003, 0x8004, 0x9001}},
+		{"plp clear", true, []byte{0xA9, 0x20, 0x48, 0x28, 0xEA, 0xEA}, 0x24, nil, []uint16{0x8002, 0x8003, 0x8004, 0x8005, 0x9001}},
+		// RTI恢复的I立即生效，返回$800A之后马上响应IRQ
+		{"rti", true, []byte{0xA9, 0x80, 0x48, 0xA9, 0x0A, 0x48, 0xA9, 0x20, 0x48, 0x40, 0xEA}, 0x24, nil,
+			[]uint16{0x8002, 0x8003, 0x8005, 0x8006, 0x8008, 0x8009, 0x800A, 0x9001}},
+		{"nmi and irq", true, []byte{0xEA, 0xEA}, 0x20, func(cpu *CPU, n int) {
+			if n == 1 {
+				cpu.SetIRQ(IRQFrame, true)
+				cpu.SetNMI(true)
+			}
+		}, []uint16{0x8001, 0xA001}},
+		// BRK压栈时出现NMI，跳到NMI的向量
+		{"brk hijack", true, []byte{0x00, 0x00}, 0x20, func(cpu *CPU, n int) {
+			if n == 3 {
+				cpu.SetNMI(true)
+			}
+		}, []uint16{0xA000, 0xA001}},
+	}
+	for _, tt := range tests {
+		got := runInterruptTest(tt.cycle, tt.prog, tt.flags, len(tt.want), tt.clock)
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: pc %04X, want %04X", tt.name, got, tt.want)
+		}
+	}
+}
+
+// 运行到STA $4014，返回从这条指令开始到DMA结束后下一条指令的时钟数减去STA自己的4个，
+// 以及期间DMC取了几个采样
+func oamDMACost(t *testing.T, cycleAccurate bool, pad []byte, dmc bool) (cost int64, odd bool, fetches int) {
+	t.Helper()
+	sta := uint16(0xE010 + len(pad) + 2)
+	prog := append(append([]byte(nil), pad...),
+		0xA9, 0x02, //                 LDA #$02
+		0x8D, 0x14, 0x40, //           STA $4014
+		0x4C, byte(sta+3), byte((sta+3)>>8)) // JMP *
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, prog))
+	if err != nil {
+		t.Fatal(err)
+	}
+	console.SetCycleAccurate(cycleAccurate)
+	for i := range console.RAM[0x200:0x300] {
+		console.RAM[0x200+i] = byte(i ^ 0x5A)
+	}
+	if dmc {
+		mem := console.CPU.Memory
+		mem.Write(0x4010, 0x0F) // 最快的速率，每432个时钟取一个字节
+		mem.Write(0x4013, 0xFF)
+		mem.Write(0x4015, 0x10)
+	}
+	cpu := console.CPU
+	for cpu.PC != sta {
+		console.Step()
+	}
+	start, length := cpu.Cycles, console.APU.dmc.currentLength
+	for cpu.PC == sta || cpu.dma.active || cpu.stall > 0 {
+		console.Step()
+	}
+	for i, v := range console.PPU.oamData {
+		if v != byte(i^0x5A) {
+			t.Fatalf("oam[%d] = %02X after DMA, want %02X", i, v, byte(i^0x5A))
+		}
+	}
+	return int64(cpu.Cycles - start - 4), start%2 == 1, int(length - console.APU.dmc.currentLength)
+}
+
+// OAM DMA占用513个时钟，从奇数周期开始时多等1个，两种CPU模式一样
+// DMA期间DMC取采样只多占2个时钟
+func TestOAMDMA(t *testing.T) {
+	for _, cycleAccurate := range []bool{false, true} {
+		var costs [2]int64
+		for _, pad := range [][]byte{{0xEA}, {0xA5, 0x00}} { // NOP / LDA $00，错开1个时钟
+			cost, odd, _ := oamDMACost(t, cycleAccurate, pad, false)
+			want := int64(513)
+			if odd {
+				want++
+			}
+			if cost != want {
+				t.Errorf("cycle accurate %v, odd %v: DMA took %d cycles, want %d", cycleAccurate, odd, cost, want)
+			}
+			withDMC, odd2, fetches := oamDMACost(t, cycleAccurate, pad, true)
+			if odd2 != odd || fetches == 0 || withDMC != cost+int64(2*fetches) {
+				t.Errorf("cycle accurate %v, odd %v: DMA with %d DMC fetches took %d cycles, want %d",
+					cycleAccurate, odd, fetches, withDMC, cost+int64(2*fetches))
+			}
+			if odd {
+				costs[1] = cost
+			} else {
+				costs[0] = cost
+			}
+		}
+		if costs != [2]int64{513, 514} {
+			t.Errorf("cycle accurate %v: costs %v, want both alignments", cycleAccurate, costs)
+		}
+	}
+}
@@ -0,0 +1,101 @@
+package nes
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+ROM加载和console创建过程中返回的错误
+调用方可以用 errors.Is 判断错误种类，用 errors.As 拿到具体信息
+*/
+
+var (
+	// 文件长度不够，头部或PRG/CHR数据缺失
+	ErrTruncated = errors.New("nes: truncated rom file")
+	// 开头不是 "NES\x1a"
+	ErrBadMagic = errors.New("nes: bad magic number, not an NES file")
+	// 未实现的mapper
+	ErrUnsupportedMapper = errors.New("nes: unsupported mapper")
+	// 头部声明了不支持的特性
+	ErrUnsupportedHeader = errors.New("nes: unsupported header feature")
+
+	// 存档数据损坏或格式不对
+	ErrBadState = errors.New("nes: invalid save state")
+	// 存档不是当前游戏的
+	ErrStateMismatch = errors.New("nes: save state belongs to a different rom")
+
+	// CPU执行了KIL指令
+	ErrJammed = errors.New("nes: cpu jammed")
+)
+
+// 文件被截断，Want是头部声明需要的长度，Got是实际长度
+type TruncatedError struct {
+	Section string
+	Want    int
+	Got     int
+}
+
+func (e *TruncatedError) Error() string {
+	return fmt.Sprintf("nes: truncated rom file: %s needs %d bytes, file has %d", e.Section, e.Want, e.Got)
+}
+
+func (e *TruncatedError) Is(target error) bool {
+	return target == ErrTruncated
+}
+
+type MapperError struct {
+	Mapper    uint16
+	SubMapper byte
+}
+
+func (e *MapperError) Error() string {
+	if e.SubMapper != 0 {
+		return fmt.Sprintf("nes: unsupported mapper %d (submapper %d)", e.Mapper, e.SubMapper)
+	}
+	return fmt.Sprintf("nes: unsupported mapper %d", e.Mapper)
+}
+
+func (e *MapperError) Is(target error) bool {
+	return target == ErrUnsupportedMapper
+}
+
+type HeaderError struct {
+	Feature string
+}
+
+func (e *HeaderError) Error() string {
+	return fmt.Sprintf("nes: unsupported header feature: %s", e.Feature)
+}
+
+func (e *HeaderError) Is(target error) bool {
+	return target == ErrUnsupportedHeader
+}
+
+// 存档版本和当前版本不一致
+type StateVersionError struct {
+	Version uint16
+	Want    uint16
+}
+
+func (e *StateVersionError) Error() string {
+	return fmt.Sprintf("nes: save state version %d, expected %d", e.Version, e.Want)
+}
+
+func (e *StateVersionError) Is(target error) bool {
+	return target == ErrBadState
+}
+
+// CPU卡死在PC处的KIL指令
+type JamError struct {
+	PC     uint16
+	Opcode byte
+}
+
+func (e *JamError) Error() string {
+	return fmt.Sprintf("nes: cpu jammed at $%04X (opcode $%02X)", e.PC, e.Opcode)
+}
+
+func (e *JamError) Is(target error) bool {
+	return target == ErrJammed
+}
@@ -0,0 +1,131 @@
+package nes
+
+import (
+	"math"
+)
+
+/*
+带限合成(blip buffer):
+APU每个CPU时钟都有一个输出电平，直接隔几十个时钟取一个点会把方波的高次谐波折叠到可听范围(混叠)。
+这里把电平的每次跳变看成一个阶跃，按跳变发生的分数位置叠加一段带限的冲激(加窗sinc)，
+读采样时再累加(积分)回阶跃，得到的就是截止在奈奎斯特频率以下的波形。
+
+之后按nesdev的描述经过主机的模拟滤波器: 90Hz高通，440Hz高通，14kHz低通
+*/
+
+const (
+	blipPhases = 32 // 跳变位置的分数精度
+	blipTaps   = 16 // 每次跳变影响的输出采样数
+	blipSize   = 32 // 环形缓冲区大小，要大于blipTaps且是2的幂
+)
+
+// 截止频率相对输出采样率的比例，留一点余量给窗函数的过渡带
+const blipCutoff = 0.45
+
+// 每个分数位置一组冲激系数，每组的和为1
+var blipKernel [blipPhases][blipTaps]float32
+
+func init() {
+	for p := 0; p < blipPhases; p++ {
+		center := float64(blipTaps/2-1) + float64(p)/blipPhases
+		var sum float64
+		var taps [blipTaps]float64
+		for i := range taps {
+			x := float64(i) - center
+			// Blackman窗
+			w := 0.42 + 0.5*math.Cos(math.Pi*x/(blipTaps/2)) + 0.08*math.Cos(2*math.Pi*x/(blipTaps/2))
+			if math.Abs(x) >= blipTaps/2 {
+				w = 0
+			}
+			taps[i] = sinc(2*blipCutoff*x) * w
+			sum += taps[i]
+		}
+		for i := range taps {
+			blipKernel[p][i] = float32(taps[i] / sum)
+		}
+	}
+}
+
+func sinc(x float64) float64 {
+	if x == 0 {
+		return 1
+	}
+	return math.Sin(math.Pi*x) / (math.Pi * x)
+}
+
+type blipBuffer struct {
+	deltas     [blipSize]float32
+	pos        int     // 下一个输出采样在deltas中的位置
+	time       float64 // 距离下一个输出采样的分数位置，[0,1)
+	step       float64 // 每个CPU时钟对应的输出采样数
+	level      float32 // 当前电平
+	integrator float32
+}
+
+// 走一个CPU时钟，level为这个时钟的输出电平，凑够一个输出采样时返回true
+func (b *blipBuffer) clock(level float32) (float32, bool) {
+	if level != b.level {
+		kernel := &blipKernel[int(b.time*blipPhases)]
+		delta := level - b.level
+		for i, k := range kernel {
+			b.deltas[(b.pos+i)&(blipSize-1)] += delta * k
+		}
+		b.level = level
+	}
+	b.time += b.step
+	if b.time < 1 {
+		return 0, false
+	}
+	b.time--
+	b.integrator += b.deltas[b.pos]
+	b.deltas[b.pos] = 0
+	b.pos = (b.pos + 1) & (blipSize - 1)
+	return b.integrator, true
+}
+
+// 一阶IIR滤波器
+type filter struct {
+	b0, b1, a1   float32
+	prevX, prevY float32
+}
+
+func (f *filter) step(x float32) float32 {
+	y := f.b0*x + f.b1*f.prevX - f.a1*f.prevY
+	f.prevX = x
+	f.prevY = y
+	return y
+}
+
+// 双线性变换，截止频率做了预畸变，-3dB点正好落在cutoff
+// 只更新系数，保留滤波器状态，动态调整采样率时不会产生爆音
+func (f *filter) setLowPass(sampleRate, cutoff float64) {
+	c := 1 / math.Tan(math.Pi*cutoff/sampleRate)
+	a0i := 1 / (1 + c)
+	f.b0 = float32(a0i)
+	f.b1 = float32(a0i)
+	f.a1 = float32((1 - c) * a0i)
+}
+
+func (f *filter) setHighPass(sampleRate, cutoff float64) {
+	c := 1 / math.Tan(math.Pi*cutoff/sampleRate)
+	a0i := 1 / (1 + c)
+	f.b0 = float32(c * a0i)
+	f.b1 = float32(-c * a0i)
+	f.a1 = float32((1 - c) * a0i)
+}
+
+// 主机的模拟滤波器
+type filterChain [3]filter
+
+func (fc *filterChain) setSampleRate(sampleRate float64) {
+	fc[0].setHighPass(sampleRate, 90)
+	fc[1].setHighPass(sampleRate, 440)
+	fc[2].setLowPass(sampleRate, 14000)
+}
+
+func (fc *filterChain) step(x float32) float32 {
+	for i := range fc {
+		x = fc[i].step(x)
+	}
+	return x
+}
@@ -0,0 +1,53 @@
+package nes
+
+import (
+	"math"
+	"math/cmplx"
+	"testing"
+)
+
+// 一阶滤波器在频率freq处的增益(dB)
+func filterGain(f *filter, sampleRate, freq float64) float64 {
+	z := cmplx.Exp(complex(0, -2*math.Pi*freq/sampleRate)) // z^-1
+	h := (complex(float64(f.b0), 0) + complex(float64(f.b1), 0)*z) /
+		(1 + complex(float64(f.a1), 0)*z)
+	return 20 * math.Log10(cmplx.Abs(h))
+}
+
+// 每一级的-3dB点都要落在截止频率上
+func TestFilterCutoff(t *testing.T) {
+	cutoffs := []float64{90, 440, 14000}
+	for _, sampleRate := range []float64{44100, 48000} {
+		var fc filterChain
+		fc.setSampleRate(sampleRate)
+		for i := range fc {
+			if g := filterGain(&fc[i], sampleRate, cutoffs[i]); math.Abs(g+3.01) > 0.05 {
+				t.Errorf("%v Hz stage %d: %.2f dB at %v Hz, want -3.01", sampleRate, i, g, cutoffs[i])
+			}
+		}
+		// 通带基本不衰减
+		if g := filterGain(&fc[0], sampleRate, 5000); g < -0.01 {
+			t.Errorf("%v Hz: high-pass 90 Hz %.3f dB at 5 kHz", sampleRate, g)
+		}
+		if g := filterGain(&fc[2], sampleRate, 100); g < -0.01 {
+			t.Errorf("%v Hz: low-pass 14 kHz %.3f dB at 100 Hz", sampleRate, g)
+		}
+	}
+}
+
+// step按系数工作: 截止频率的正弦稳定后幅度是1/√2
+func TestFilterStep(t *testing.T) {
+	const sampleRate = 44100.0
+	var f filter
+	f.setLowPass(sampleRate, 14000)
+	peak := 0.0
+	for i := 0; i < 4410; i++ {
+		y := float64(f.step(float32(math.Sin(2 * math.Pi * 14000 * float64(i) / sampleRate))))
+		if i > 441 && math.Abs(y) > peak {
+			peak = math.Abs(y)
+		}
+	}
+	if math.Abs(peak-math.Sqrt2/2) > 0.02 {
+		t.Errorf("14 kHz sine peak %.3f, want %.3f", peak, math.Sqrt2/2)
+	}
+}
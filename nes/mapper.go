@@ -1,6 +1,9 @@
 package nes
 
-import "fmt"
+import (
+	"sort"
+	"sync"
+)
 
 type Mapper interface {
 	Read(address uint16) byte
@@ -9,20 +12,96 @@ type Mapper interface {
 	Step()
 }
 
+// 可选接口: 需要观察PPU地址总线的mapper实现
+// PPU每次访问显存(渲染时取名称表/图案，$2007读写，$2006写入地址)都会调用，
+// 可以从A12的上升沿数扫描线(MMC3)，或者从名称表的读取判断当前的位置
+type PPUBusMapper interface {
+	PPUAddress(address uint16)
+}
+
+// 可选接口: 按CPU时钟(M2)驱动的mapper实现，每个CPU时钟调用一次
+// Step仍然每个PPU时钟调用一次
+type CPUClockedMapper interface {
+	ClockCPU()
+}
+
+// 可选接口: 在$4020-$5FFF有寄存器或者内存的mapper实现
+// 读的时候第二个返回值为false表示没有驱动数据总线(open bus)
+type ExpansionMapper interface {
+	ReadExpansion(address uint16) (byte, bool)
+	WriteExpansion(address uint16, value byte)
+}
+
+// 可选接口: 带扩展音源的mapper实现，返回当前的输出电平，和APU的输出相加
+// 每个CPU时钟都会取一次，音源自己的计时放在ClockCPU里
+type AudioMapper interface {
+	AudioOutput() float32
+}
+
+// 可选接口: 读取有副作用的mapper实现(比如MMC5读PRG时锁存PCM数据、检测NMI向量)
+// 调试和跟踪用CPUMemory.Peek时优先调用它，只返回值，不改变任何状态
+type PeekMapper interface {
+	Peek(address uint16) byte
+}
+
+// mapper的IRQ输出通过Console.SetMapperIRQ驱动，是电平触发的，确认之后要自己拉低
+
+// 创建mapper，卡带的内容不支持时返回错误
+type MapperConstructor func(card *Cartridge, console *Console) (Mapper, error)
+
+// 一种mapper(板子)的注册信息
+type MapperInfo struct {
+	Number     uint16 // mapper号，NES 2.0下为12位
+	SubMappers []byte // 支持的子mapper号，为空时不区分子mapper
+	Name       string // 板子名称，如 NROM/MMC1
+	New        MapperConstructor
+}
+
+func (info *MapperInfo) supports(subMapper byte) bool {
+	if len(info.SubMappers) == 0 {
+		return true
+	}
+	for _, s := range info.SubMappers {
+		if s == subMapper {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	mappersLock sync.RWMutex
+	mappers     = map[uint16]MapperInfo{}
+)
+
+// 注册mapper，各个mapper文件在init中注册自己，
+// 外部的包也可以用它加入自定义或者盗版的板子，同一个号再次注册时覆盖之前的
+func RegisterMapper(info MapperInfo) {
+	mappersLock.Lock()
+	defer mappersLock.Unlock()
+	mappers[info.Number] = info
+}
+
+// 按mapper号从小到大列出已注册的mapper
+func Mappers() []MapperInfo {
+	mappersLock.RLock()
+	defer mappersLock.RUnlock()
+	list := make([]MapperInfo, 0, len(mappers))
+	for _, info := range mappers {
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Number < list[j].Number
+	})
+	return list
+}
+
 func NewMapper(card *Cartridge, console *Console) (Mapper, error) {
-	switch card.Mapper {
-	case 0:
-		return NewMapper0(card), nil
-	case 1:
-		return NewMapper1(card), nil
-	case 2:
-		return NewMapper0(card), nil
-	case 3:
-		return NewMapper3(card), nil
-	case 4:
-		return NewMapper4(card, console), nil
-	default:
-		fmt.Printf("unsupported mapper \n")
-		return nil, nil
+	mappersLock.RLock()
+	info, ok := mappers[card.Mapper]
+	mappersLock.RUnlock()
+	if !ok || !info.supports(card.SubMapper) {
+		return nil, &MapperError{card.Mapper, card.SubMapper}
 	}
+	return info.New(card, console)
 }
@@ -29,6 +29,14 @@ $FFFE-FFFF = IRQ/BRK
 PRG每块16kb（0x4000） CHR每块8kb(0x2000)
 */
 
+func init() {
+	newMapper0 := func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper0(card), nil
+	}
+	RegisterMapper(MapperInfo{Number: 0, Name: "NROM", New: newMapper0})
+	RegisterMapper(MapperInfo{Number: 2, Name: "UxROM", New: newMapper0})
+}
+
 type Mapper0 struct {
 	card     *Cartridge
 	prgBanks int
@@ -63,6 +71,16 @@ func (mapper *Mapper0) Read(addr uint16) byte {
 	return 0
 }
 
+func (mapper *Mapper0) PRGOffset(addr uint16) int {
+	switch {
+	case addr >= 0xC000:
+		return mapper.prgBank2*0x4000 + int(addr-0xC000)
+	case addr >= 0x8000:
+		return mapper.prgBank1*0x4000 + int(addr-0x8000)
+	}
+	return -1
+}
+
 func (mapper *Mapper0) Write(addr uint16, value byte) {
 	card := mapper.card
 
@@ -80,3 +98,9 @@ func (mapper *Mapper0) Write(addr uint16, value byte) {
 }
 
 func (mapper *Mapper0) Step() {}
+
+func (mapper *Mapper0) Serialize(s *Serializer) {
+	s.Int(&mapper.prgBanks)
+	s.Int(&mapper.prgBank1)
+	s.Int(&mapper.prgBank2)
+}
@@ -15,6 +15,12 @@ type Mapper1 struct {
 	chrOffsets    [2]int
 }
 
+func init() {
+	RegisterMapper(MapperInfo{Number: 1, Name: "MMC1", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper1(card), nil
+	}})
+}
+
 func NewMapper1(card *Cartridge) Mapper {
 	m := Mapper1{}
 	m.card = card
@@ -162,6 +168,14 @@ func (m *Mapper1) Read(addr uint16) byte {
 	return 0
 }
 
+func (m *Mapper1) PRGOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	addr = addr - 0x8000
+	return m.prgOffsets[addr/0x4000] + int(addr%0x4000)
+}
+
 func (m *Mapper1) Write(addr uint16, value byte) {
 	switch {
 	case addr < 0x2000:
@@ -177,3 +191,19 @@ func (m *Mapper1) Write(addr uint16, value byte) {
 }
 
 func (m *Mapper1) Step() {}
+
+func (m *Mapper1) Serialize(s *Serializer) {
+	s.Byte(&m.shiftRegister)
+	s.Byte(&m.ctrlRegister)
+	s.Byte(&m.prgMode)
+	s.Byte(&m.chrMode)
+	s.Byte(&m.chrBank0)
+	s.Byte(&m.chrBank1)
+	s.Byte(&m.prgBank)
+	for i := range m.prgOffsets {
+		s.Int(&m.prgOffsets[i])
+	}
+	for i := range m.chrOffsets {
+		s.Int(&m.chrOffsets[i])
+	}
+}
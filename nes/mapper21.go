@@ -0,0 +1,272 @@
+package nes
+
+/*
+Konami VRC2/VRC4，mapper 21/22/23/25共用这一个实现，宇宙巡航舰2、大盗五右卫门等使用
+
+两种芯片的寄存器布局一样，只是寄存器的A0/A1接在CPU不同的地址线上，由mapper号和子mapper区分:
+  21: 1 VRC4a(A1,A2) 2 VRC4c(A6,A7)
+  22: VRC2a(A1,A0)，CHR bank的最低位没接
+  23: 1 VRC4f(A0,A1) 2 VRC4e(A2,A3) 3 VRC2b(A0,A1)
+  25: 1 VRC4b(A1,A0) 2 VRC4d(A3,A2) 3 VRC2c(A1,A0)
+iNES格式或者子mapper为0时两组地址线都接上，同一个游戏只会用到其中一组。
+23/25这时分不出VRC2还是VRC4: 没有电池、NES 2.0头部也没给出PRG RAM大小的按VRC2，其他按VRC4。
+
+$8000 PRG bank 0   $A000 PRG bank 1   $9000 镜像   $9002 bit 0 PRG RAM开关 bit 1 PRG模式(VRC4)
+$B000-$E003 8个1KB CHR bank，每个分低4位和高4位两次写
+$F000-$F003 IRQ(VRC4)
+*/
+
+// 寄存器的A0/A1分别接到CPU的哪些地址线
+type vrcWiring struct {
+	a0, a1 uint16
+	vrc2   bool
+}
+
+var vrcWirings = map[uint16][4]vrcWiring{
+	21: {{0x42, 0x84, false}, {0x02, 0x04, false}, {0x40, 0x80, false}},
+	22: {{0x02, 0x01, true}},
+	23: {{0x05, 0x0A, false}, {0x01, 0x02, false}, {0x04, 0x08, false}, {0x01, 0x02, true}},
+	25: {{0x0A, 0x05, false}, {0x02, 0x01, false}, {0x08, 0x04, false}, {0x02, 0x01, true}},
+}
+
+type Mapper21 struct {
+	card     *Cartridge
+	console  *Console
+	wiring   vrcWiring
+	chrShift uint // VRC2a的CHR bank要右移一位
+
+	prgBanks [2]byte
+	prgSwap  bool // VRC4: $8000和$C000互换
+	chrBanks [8]uint16
+	hasRAM   bool // $6000-$7FFF有PRG RAM
+	ramOn    bool // VRC4: $9002 bit 0，关闭时和没有RAM一样
+	latch    byte // 没有PRG RAM的VRC2: $6000-$6FFF的1位锁存器，游戏拿来和EEPROM通信(microwire)
+
+	irqLatch     byte
+	irqCounter   byte
+	irqPrescaler int  // 按扫描线计数时每3个CPU时钟减3，减到0算一条扫描线(341个PPU时钟)
+	irqEnable    bool // E
+	irqEnableAck bool // A，确认之后把E恢复成这个值
+	irqCycleMode bool // M，1时每个CPU时钟计数一次
+
+	prgOffsets [4]int
+	chrOffsets [8]int
+}
+
+func init() {
+	for number, wirings := range vrcWirings {
+		var subMappers []byte
+		for sub, w := range wirings {
+			if w.a0 != 0 {
+				subMappers = append(subMappers, byte(sub))
+			}
+		}
+		name := "VRC2/VRC4"
+		switch number {
+		case 21:
+			name = "VRC4"
+		case 22:
+			name = "VRC2"
+		}
+		RegisterMapper(MapperInfo{Number: number, SubMappers: subMappers, Name: name, New: func(card *Cartridge, console *Console) (Mapper, error) {
+			return NewMapper21(card, console), nil
+		}})
+	}
+}
+
+func NewMapper21(card *Cartridge, console *Console) Mapper {
+	m := &Mapper21{card: card, console: console}
+	m.wiring = vrcWirings[card.Mapper][card.SubMapper]
+	if card.Mapper == 22 {
+		m.chrShift = 1
+	}
+	headerRAM := card.NES2 && card.PRGRAMSize+card.PRGNVRAMSize > 0
+	if card.SubMapper == 0 && (card.Mapper == 23 || card.Mapper == 25) {
+		m.wiring.vrc2 = !card.Battery && !headerRAM
+	}
+	// iNES头部没有RAM大小，VRC4按有RAM处理
+	m.hasRAM = card.Battery || headerRAM || !card.NES2 && !m.wiring.vrc2
+	// 上电时的状态不确定，先打开，VRC2没有这个开关
+	m.ramOn = true
+	m.irqPrescaler = 341
+	m.updateBanks()
+	return m
+}
+
+// 按接线把CPU地址换算成$x000-$x003
+func (m *Mapper21) register(addr uint16) uint16 {
+	reg := addr & 0xF000
+	if addr&m.wiring.a0 != 0 {
+		reg |= 1
+	}
+	if addr&m.wiring.a1 != 0 {
+		reg |= 2
+	}
+	return reg
+}
+
+func (m *Mapper21) Step() {
+}
+
+// VRC4的IRQ计数器按CPU时钟走，扫描线模式用分频器模拟341个PPU时钟
+func (m *Mapper21) ClockCPU() {
+	if !m.irqEnable {
+		return
+	}
+	if m.irqCycleMode {
+		m.clockIRQ()
+		return
+	}
+	m.irqPrescaler -= 3
+	if m.irqPrescaler <= 0 {
+		m.irqPrescaler += 341
+		m.clockIRQ()
+	}
+}
+
+func (m *Mapper21) clockIRQ() {
+	if m.irqCounter == 0xFF {
+		m.irqCounter = m.irqLatch
+		m.console.SetMapperIRQ(true)
+	} else {
+		m.irqCounter++
+	}
+}
+
+func (m *Mapper21) Read(addr uint16) byte {
+	switch {
+	case addr < 0x2000:
+		return m.card.CHR[m.chrOffsets[addr/0x400]+int(addr%0x400)]
+	case addr >= 0x8000:
+		addr -= 0x8000
+		return m.card.PRG[m.prgOffsets[addr/0x2000]+int(addr%0x2000)]
+	case addr >= 0x6000:
+		if m.hasRAM && m.ramOn {
+			return m.card.SRAM[addr-0x6000]
+		}
+		// 没有接的数据线保持地址的高字节
+		if m.wiring.vrc2 && !m.hasRAM && addr < 0x7000 {
+			return byte(addr>>8)&0xFE | m.latch
+		}
+		return byte(addr >> 8)
+	}
+	return 0
+}
+
+func (m *Mapper21) PRGOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	addr -= 0x8000
+	return m.prgOffsets[addr/0x2000] + int(addr%0x2000)
+}
+
+func (m *Mapper21) Write(addr uint16, value byte) {
+	switch {
+	case addr < 0x2000:
+		if m.card.HasCHRRAM() {
+			m.card.CHR[m.chrOffsets[addr/0x400]+int(addr%0x400)] = value
+		}
+	case addr >= 0x8000:
+		m.writeRegister(m.register(addr), value)
+	case addr >= 0x6000:
+		if m.hasRAM && m.ramOn {
+			m.card.SRAM[addr-0x6000] = value
+		} else if m.wiring.vrc2 && !m.hasRAM && addr < 0x7000 {
+			m.latch = value & 1
+		}
+	}
+}
+
+func (m *Mapper21) writeRegister(reg uint16, value byte) {
+	switch {
+	case reg <= 0x8003:
+		m.prgBanks[0] = value & 0x1F
+	case reg <= 0x9003:
+		if m.wiring.vrc2 {
+			m.setMirroring(value & 1)
+		} else if reg == 0x9000 {
+			m.setMirroring(value & 3)
+		} else if reg == 0x9002 {
+			m.ramOn = value&1 != 0
+			m.prgSwap = value&2 != 0
+		}
+	case reg <= 0xA003:
+		m.prgBanks[1] = value & 0x1F
+	case reg <= 0xE003:
+		// $B000: 0号低4位 $B001: 0号高位 $B002: 1号低4位 $B003: 1号高位，之后每$1000两个
+		index := int(reg-0xB000)/0x1000*2 + int(reg&2)/2
+		bank := m.chrBanks[index]
+		if reg&1 == 0 {
+			bank = bank&0x1F0 | uint16(value&0x0F)
+		} else {
+			bank = bank&0x0F | uint16(value&0x1F)<<4
+		}
+		m.chrBanks[index] = bank
+	case reg == 0xF000:
+		m.irqLatch = m.irqLatch&0xF0 | value&0x0F
+	case reg == 0xF001:
+		m.irqLatch = m.irqLatch&0x0F | value<<4
+	case reg == 0xF002:
+		m.irqEnableAck = value&1 != 0
+		m.irqEnable = value&2 != 0
+		m.irqCycleMode = value&4 != 0
+		if m.irqEnable {
+			m.irqCounter = m.irqLatch
+			m.irqPrescaler = 341
+		}
+		m.console.SetMapperIRQ(false)
+	case reg == 0xF003:
+		m.irqEnable = m.irqEnableAck
+		m.console.SetMapperIRQ(false)
+	}
+	m.updateBanks()
+}
+
+// 0 垂直 1 水平 2/3 单屏
+func (m *Mapper21) setMirroring(value byte) {
+	switch value {
+	case 0:
+		m.card.Mirror = MirrorVertical
+	case 1:
+		m.card.Mirror = MirrorHorizontal
+	case 2:
+		m.card.Mirror = MirrorSingle0
+	case 3:
+		m.card.Mirror = MirrorSingle1
+	}
+}
+
+func (m *Mapper21) updateBanks() {
+	prgCount := len(m.card.PRG) / 0x2000
+	banks := [4]int{int(m.prgBanks[0]), int(m.prgBanks[1]), prgCount - 2, prgCount - 1}
+	if m.prgSwap {
+		banks[0], banks[2] = banks[2], banks[0]
+	}
+	for i, bank := range banks {
+		m.prgOffsets[i] = bank % prgCount * 0x2000
+	}
+	chrCount := len(m.card.CHR) / 0x400
+	for i, bank := range m.chrBanks {
+		m.chrOffsets[i] = int(bank>>m.chrShift) % chrCount * 0x400
+	}
+}
+
+func (m *Mapper21) Serialize(s *Serializer) {
+	s.Bytes(m.prgBanks[:])
+	s.Bool(&m.prgSwap)
+	s.Bool(&m.ramOn)
+	for i := range m.chrBanks {
+		s.Uint16(&m.chrBanks[i])
+	}
+	s.Byte(&m.latch)
+	s.Byte(&m.irqLatch)
+	s.Byte(&m.irqCounter)
+	s.Int(&m.irqPrescaler)
+	s.Bool(&m.irqEnable)
+	s.Bool(&m.irqEnableAck)
+	s.Bool(&m.irqCycleMode)
+	if s.Loading() {
+		m.updateBanks()
+	}
+}
@@ -0,0 +1,189 @@
+package nes
+
+import (
+	"testing"
+)
+
+// 取接线里最低的一根地址线
+func lowestLine(mask uint16) uint16 {
+	return mask & -mask
+}
+
+func TestVRCWiring(t *testing.T) {
+	for mapper, wirings := range vrcWirings {
+		for sub, w := range wirings {
+			if w.a0 == 0 {
+				continue
+			}
+			console, err := NewConsole(testROM(mapper, byte(sub), 0x20000, 0x8000, idleProg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			a0, a1 := lowestLine(w.a0), lowestLine(w.a1)
+			m := console.Mapper
+			m.Write(0x8000, 5)
+			m.Write(0xA000, 6)
+			// 1号CHR bank = $13
+			m.Write(0xB000|a1, 0x03)
+			m.Write(0xB000|a1|a0, 0x01)
+			if v := m.Read(0x8000); v != 5 {
+				t.Errorf("mapper %d.%d: $8000 bank %d, want 5", mapper, sub, v)
+			}
+			if v := m.Read(0xA000); v != 6 {
+				t.Errorf("mapper %d.%d: $A000 bank %d, want 6", mapper, sub, v)
+			}
+			if v := m.Read(0xC000); v != 14 {
+				t.Errorf("mapper %d.%d: $C000 bank %d, want 14", mapper, sub, v)
+			}
+			want := byte(0x13)
+			if mapper == 22 {
+				want >>= 1
+			}
+			if v := m.Read(0x0400) >> 3; v != want {
+				t.Errorf("mapper %d.%d: CHR $0400 bank %d, want %d", mapper, sub, v, want)
+			}
+			// 子mapper 0按头部选VRC2或VRC4
+			if !m.(*Mapper21).wiring.vrc2 {
+				// PRG模式1: $8000固定为倒数第二个，$C000可切换
+				m.Write(0x9000|a1, 0x02)
+				if v := m.Read(0x8000); v != 14 {
+					t.Errorf("mapper %d.%d: swapped $8000 bank %d, want 14", mapper, sub, v)
+				}
+				if v := m.Read(0xC000); v != 5 {
+					t.Errorf("mapper %d.%d: swapped $C000 bank %d, want 5", mapper, sub, v)
+				}
+			}
+		}
+	}
+}
+
+func TestVRC2Latch(t *testing.T) {
+	console, err := NewConsole(testROM(22, 0, 0x20000, 0x8000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x6000, 0xFF)
+	if v := cpu.Read(0x6000); v != 0x61 {
+		t.Errorf("$6000 = %02X, want 61", v)
+	}
+	cpu.Write(0x6000, 0xFE)
+	if v := cpu.Read(0x6000); v != 0x60 {
+		t.Errorf("$6000 = %02X, want 60", v)
+	}
+}
+
+// 子mapper 0的23/25: 没有电池也没有RAM大小时是VRC2，$6000是锁存器
+func TestVRCSubMapper0(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header func(rom []byte)
+		vrc2   bool
+	}{
+		{"no ram", func(rom []byte) {}, true},
+		{"prg ram", func(rom []byte) { rom[10] = 0x07 }, false},
+		{"battery", func(rom []byte) { rom[6] |= 0x02 }, false},
+	} {
+		for _, mapper := range []uint16{23, 25} {
+			rom := testROM(mapper, 0, 0x20000, 0x8000, idleProg)
+			tt.header(rom)
+			console, err := NewConsole(rom)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if vrc2 := console.Mapper.(*Mapper21).wiring.vrc2; vrc2 != tt.vrc2 {
+				t.Errorf("mapper %d %s: vrc2 = %v, want %v", mapper, tt.name, vrc2, tt.vrc2)
+			}
+			cpu := console.CPU.Memory
+			cpu.Write(0x6000, 0x55)
+			want := byte(0x55)
+			if tt.vrc2 {
+				want = 0x61
+			}
+			if v := cpu.Read(0x6000); v != want {
+				t.Errorf("mapper %d %s: $6000 = %02X, want %02X", mapper, tt.name, v, want)
+			}
+		}
+	}
+}
+
+// VRC4的$9002 bit 0开关PRG RAM，关闭时读到的是open bus，写入无效
+func TestVRC4WRAM(t *testing.T) {
+	rom := testROM(21, 1, 0x20000, 0x8000, idleProg)
+	rom[10] = 0x07 // 8KB PRG RAM
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	// VRC4a: A1/A2，$9004是$9002
+	cpu.Write(0x9004, 0x01)
+	cpu.Write(0x6000, 0x55)
+	if v := cpu.Read(0x6000); v != 0x55 {
+		t.Errorf("$6000 = %02X with RAM on, want 55", v)
+	}
+	cpu.Write(0x9004, 0x00)
+	cpu.Write(0x6000, 0xAA)
+	if v := cpu.Read(0x6000); v != 0x60 {
+		t.Errorf("$6000 = %02X with RAM off, want open bus 60", v)
+	}
+	cpu.Write(0x9004, 0x01)
+	if v := cpu.Read(0x6000); v != 0x55 {
+		t.Errorf("$6000 = %02X after RAM back on, want 55", v)
+	}
+
+	// 头部没有RAM的VRC4不是VRC2，也没有锁存器
+	console, err = NewConsole(testROM(21, 1, 0x20000, 0x8000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu = console.CPU.Memory
+	cpu.Write(0x6000, 0x01)
+	if v := cpu.Read(0x6000); v != 0x60 {
+		t.Errorf("$6000 = %02X without RAM, want open bus 60", v)
+	}
+}
+
+func TestVRC4IRQ(t *testing.T) {
+	console, err := NewConsole(testROM(21, 1, 0x20000, 0x8000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := console.Mapper
+	// VRC4a: A1/A2
+	m.Write(0xF000, 0x6)
+	m.Write(0xF002, 0xF)
+	m.Write(0xF004, 0x3) // 开启，确认后保持开启，扫描线模式
+	var lines []int
+	for len(lines) < 3 && console.PPU.Frame < 5 {
+		console.Step()
+		if console.CPU.IRQ(IRQMapper) {
+			lines = append(lines, console.PPU.ScanLine)
+			m.Write(0xF006, 0)
+		}
+	}
+	if len(lines) < 3 {
+		t.Fatalf("irq lines %v", lines)
+	}
+	// 从$F6数到$FF再溢出，10条扫描线一次
+	for i := 1; i < len(lines); i++ {
+		if d := (lines[i] - lines[i-1] + 262) % 262; d != 10 {
+			t.Errorf("irq lines %v, want every 10 lines", lines)
+			break
+		}
+	}
+
+	// CPU时钟模式: 10个时钟一次，Step按指令走，发现IRQ最多晚一条指令
+	m.Write(0xF004, 0x7)
+	var cycles []uint64
+	for len(cycles) < 11 {
+		console.Step()
+		if console.CPU.IRQ(IRQMapper) {
+			cycles = append(cycles, console.CPU.Cycles)
+			m.Write(0xF006, 0)
+		}
+	}
+	if span := cycles[10] - cycles[0]; span < 98 || span > 102 {
+		t.Errorf("10 irqs in %d cycles, want 100", span)
+	}
+}
@@ -13,6 +13,12 @@ type Mapper3 struct {
 	prgBank2 int
 }
 
+func init() {
+	RegisterMapper(MapperInfo{Number: 3, Name: "CNROM", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper3(card), nil
+	}})
+}
+
 func NewMapper3(cartridge *Cartridge) Mapper {
 	prgBanks := len(cartridge.PRG) / 0x4000
 	return &Mapper3{cartridge, 0, 0, prgBanks - 1}
@@ -38,6 +44,16 @@ func (m *Mapper3) Read(address uint16) byte {
 	return 0
 }
 
+func (m *Mapper3) PRGOffset(address uint16) int {
+	switch {
+	case address >= 0xC000:
+		return m.prgBank2*0x4000 + int(address-0xC000)
+	case address >= 0x8000:
+		return m.prgBank1*0x4000 + int(address-0x8000)
+	}
+	return -1
+}
+
 func (m *Mapper3) Write(address uint16, value byte) {
 	switch {
 	case address < 0x2000:
@@ -55,3 +71,9 @@ func (m *Mapper3) Write(address uint16, value byte) {
 }
 
 func (mapper *Mapper3) Step() {}
+
+func (m *Mapper3) Serialize(s *Serializer) {
+	s.Int(&m.chrBank)
+	s.Int(&m.prgBank1)
+	s.Int(&m.prgBank2)
+}
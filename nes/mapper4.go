@@ -29,39 +29,62 @@ type Mapper4 struct {
 	reload     byte    // 计数器总时长
 	timerValue byte    // 计数器当前值
 	irqEnable  bool    // IRQ中断开关
+	irqReload  bool    // 写$C001之后，下次时钟重新装载计数器
+	oldIRQ     bool    // MMC3A等老版本: 只有减到0时才触发IRQ，重新装载成0不触发
+	a12        bool    // PPU地址总线A12的当前电平
+	a12Low     int     // A12保持低电平经过的CPU时钟数，到3为止
 	// 这里采用和参考项目同样的方法，计算出每个bank对应的地址offset
 	prgOffsets [4]int
 	chrOffsets [8]int
 }
 
+// 计数器由PPUAddress里A12的上升沿驱动，不再按PPU的位置猜
 func (m *Mapper4) Step() {
-	ppu := m.console.PPU
-	if ppu.ScanLine > 239 && ppu.ScanLine < 261 {
-		return
+}
+
+// 背景和精灵用不同的图案表时，每条扫描线A12会有一次由低变高，
+// 卡带上的滤波要求A12先保持低电平至少3个CPU时钟，8x16精灵取图案时的短暂跳变会被忽略
+func (m *Mapper4) PPUAddress(addr uint16) {
+	a12 := addr&0x1000 != 0
+	if a12 && !m.a12 && m.a12Low >= 3 {
+		m.StepScanLineCounter()
 	}
-	if ppu.flagShowBack == 0 && ppu.flagShowSprite == 0 {
-		return
+	if !a12 && m.a12 {
+		m.a12Low = 0
 	}
-	// nesdev:  presumably at PPU cycle 260 of the current scanline.
-	if ppu.Cycle != 260 {
-		return
+	m.a12 = a12
+}
+
+func (m *Mapper4) ClockCPU() {
+	if !m.a12 && m.a12Low < 3 {
+		m.a12Low++
 	}
-	m.StepScanLineCounter()
 }
 
 func (m *Mapper4) StepScanLineCounter() {
-	if m.timerValue == 0 {
+	// 老版本只有计数器原来不为0或者刚写过$C001时才触发
+	trigger := !m.oldIRQ || m.timerValue != 0 || m.irqReload
+	if m.timerValue == 0 || m.irqReload {
 		m.timerValue = m.reload
+		m.irqReload = false
 	} else {
 		m.timerValue--
-		if m.timerValue == 0 && m.irqEnable {
-			m.console.CPU.TriggerIRQ()
-		}
 	}
+	if m.timerValue == 0 && m.irqEnable && trigger {
+		m.console.SetMapperIRQ(true)
+	}
+}
+
+func init() {
+	RegisterMapper(MapperInfo{Number: 4, Name: "MMC3", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper4(card, console), nil
+	}})
 }
 
 func NewMapper4(card *Cartridge, console *Console) Mapper {
 	m := Mapper4{card: card, console: console}
+	// NES 2.0子mapper 4是MMC3A
+	m.oldIRQ = card.SubMapper == 4
 	// 这里注意要先把prg预制好
 	m.prgOffsets[0] = m.getPrgOffset(0)
 	m.prgOffsets[1] = m.getPrgOffset(1)
@@ -90,6 +113,10 @@ func (m *Mapper4) setBankData(value byte) {
 
 // 这个居然是用来更改卡带的Mirror属性的
 func (m *Mapper4) setMirroring(value byte) {
+	// 四屏的卡带(如Gauntlet)镜像是焊死的
+	if m.card.Mirror == MirrorFour {
+		return
+	}
 	if value&1 > 0 {
 		m.card.Mirror = 0
 	} else {
@@ -103,11 +130,13 @@ func (m *Mapper4) setIRQLatch(value byte) {
 
 func (m *Mapper4) setIRQReload(value byte) {
 	m.timerValue = 0
-	// m.reload = value
+	m.irqReload = true
 }
 
+// 关闭IRQ同时确认已经发出的请求
 func (m *Mapper4) setIRQDisable(value byte) {
 	m.irqEnable = false
+	m.console.SetMapperIRQ(false)
 }
 
 func (m *Mapper4) setIRQEnable(value byte) {
@@ -166,6 +195,14 @@ func (m *Mapper4) Read(addr uint16) byte {
 	return 0
 }
 
+func (m *Mapper4) PRGOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	addr = addr - 0x8000
+	return m.prgOffsets[addr/0x2000] + int(addr%0x2000)
+}
+
 func (m *Mapper4) Write(addr uint16, value byte) {
 	switch {
 	case addr < 0x2000:
@@ -250,6 +287,25 @@ func (m *Mapper4) calculateBank() {
 	}
 }
 
+func (m *Mapper4) Serialize(s *Serializer) {
+	s.Byte(&m.regIndex)
+	s.Bytes(m.registers[:])
+	s.Byte(&m.prgMode)
+	s.Byte(&m.chrMode)
+	s.Byte(&m.reload)
+	s.Byte(&m.timerValue)
+	s.Bool(&m.irqEnable)
+	s.Bool(&m.irqReload)
+	s.Bool(&m.a12)
+	s.Int(&m.a12Low)
+	for i := range m.prgOffsets {
+		s.Int(&m.prgOffsets[i])
+	}
+	for i := range m.chrOffsets {
+		s.Int(&m.chrOffsets[i])
+	}
+}
+
 /*
 关于
 
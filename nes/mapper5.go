@@ -0,0 +1,624 @@
+package nes
+
+/*
+MMC5 (ExROM)，恶魔城3、Just Breed、光荣的策略游戏等使用
+
+寄存器都在$5000-$5FFF:
+$5000-$5015 扩展音源: 两个没有扫描单元的方波 + 8位PCM
+$5100 PRG模式   $5101 CHR模式   $5102/$5103 PRG RAM写保护   $5104 ExRAM模式
+$5105 名称表映射 $5106/$5107 填充模式的tile和颜色
+$5113-$5117 PRG bank   $5120-$5130 CHR bank
+$5200-$5202 垂直分屏   $5203/$5204 扫描线IRQ   $5205/$5206 乘法器
+$5C00-$5FFF 1KB ExRAM
+
+MMC5看不到PPU的A12以外的控制信号，扫描线靠总线上连续三次读取同一个名称表地址判断
+(每行末尾337/339两次多余的读取加上下一行第一次读取)，PPU连续3个CPU时钟没有读取则认为一帧结束。
+取图案时分辨背景/精灵、分屏的tile列号等直接看PPU当前的位置。
+*/
+
+type Mapper5 struct {
+	NameTables
+	card    *Cartridge
+	console *Console
+
+	prgMode    byte
+	chrMode    byte
+	ramProtect [2]byte
+	exMode     byte    // ExRAM模式 0: 名称表 1: 扩展属性 2: CPU读写RAM 3: CPU只读
+	ntMapping  byte    // $5105
+	fillTile   byte    // 填充模式的tile
+	fillColor  byte    // 填充模式的调色板
+	prgRegs    [5]byte // $5113-$5117
+	chrRegs    [12]uint16
+	chrUpper   byte // $5130，CHR bank的高2位
+	lastChrB   bool // 最后写的是不是$5128-$512B，不渲染时用这组
+	exRAM      [0x400]byte
+	fill       [0x400]byte // 填充模式的名称表，只读
+	zero       [0x400]byte // ExRAM不作名称表时读出全0
+
+	splitCtrl   byte // $5200 bit 7 开启 bit 6 右侧 bit 0-4 分界的tile列
+	splitScroll byte
+	splitPage   byte
+	exAttr      byte // 扩展属性模式下最近一次取名称表对应的ExRAM字节
+
+	irqCompare byte
+	irqEnable  bool
+	irqPending bool
+	inFrame    bool
+	scanline   byte
+	lastNT     uint16 // 上一次PPU读取的名称表地址，不是名称表时为0
+	ntReads    int    // 连续读取同一名称表地址的次数
+	ppuIdle    int    // PPU没有读取经过的CPU时钟数
+
+	multiplicand byte
+	multiplier   byte
+
+	pulse1    Pulse
+	pulse2    Pulse
+	pcm       byte
+	pcmRead   bool // PCM读模式: CPU读$8000-$BFFF时的数据作为输出
+	pcmIRQOn  bool
+	pcmIRQ    bool
+	audioTick int
+	frameTick float64
+
+	prgOffsets [5]int // $6000-$FFFF每8KB一个
+	prgRAM     [5]bool
+	chrA       [8]int // 8x8精灵和8x16精灵用的CHR bank，1KB一个
+	chrB       [8]int // 8x16精灵时背景用的CHR bank
+}
+
+func init() {
+	RegisterMapper(MapperInfo{Number: 5, Name: "MMC5", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper5(card, console), nil
+	}})
+}
+
+func NewMapper5(card *Cartridge, console *Console) Mapper {
+	// iNES头部没有RAM大小，光荣的游戏有64KB的PRG RAM，按最大的给
+	if !card.NES2 && len(card.SRAM) < 0x10000 {
+		sram := make([]byte, 0x10000)
+		copy(sram, card.SRAM)
+		card.SRAM = sram
+		card.PRGRAMSize = len(sram)
+	}
+	m := &Mapper5{card: card, console: console}
+	m.prgMode = 3
+	m.prgRegs[4] = 0xFF
+	m.chrMode = 3
+	// 游戏会自己写$5105，上电时先按头部的镜像方式
+	for slot, page := range MirrorLookup[card.Mirror] {
+		if page < 2 {
+			m.ntMapping |= byte(page) << (slot * 2)
+		}
+	}
+	m.updatePRG()
+	m.updateCHR()
+	m.updateNameTables()
+	return m
+}
+
+func (m *Mapper5) Step() {
+}
+
+// 音源和帧结束的判断按CPU时钟走
+func (m *Mapper5) ClockCPU() {
+	if m.ppuIdle < 3 {
+		m.ppuIdle++
+		if m.ppuIdle == 3 {
+			m.inFrame = false
+			m.lastNT = 0
+			m.ntReads = 0
+		}
+	}
+	// 方波的计时器和APU一样每2个CPU时钟走一次
+	m.audioTick ^= 1
+	if m.audioTick == 0 {
+		m.pulse1.stepTimer()
+		m.pulse2.stepTimer()
+	}
+	// 包络和长度计数器固定按240Hz走，不受$4017影响
+	m.frameTick++
+	if m.frameTick >= m.console.APU.framePeriod {
+		m.frameTick -= m.console.APU.framePeriod
+		m.pulse1.stepEnvelope()
+		m.pulse2.stepEnvelope()
+		m.pulse1.stepLength()
+		m.pulse2.stepLength()
+	}
+}
+
+func (m *Mapper5) PPUAddress(addr uint16) {
+	m.ppuIdle = 0
+	if addr < 0x2000 || addr >= 0x3000 {
+		m.lastNT = 0
+		m.ntReads = 0
+		return
+	}
+	if addr == m.lastNT {
+		m.ntReads++
+		if m.ntReads == 2 {
+			m.scanlineStart()
+		}
+	} else {
+		m.ntReads = 0
+	}
+	m.lastNT = addr
+}
+
+func (m *Mapper5) scanlineStart() {
+	if !m.inFrame {
+		m.inFrame = true
+		m.scanline = 0
+		m.irqPending = false
+	} else {
+		m.scanline++
+		if m.scanline == m.irqCompare {
+			m.irqPending = true
+		}
+	}
+	m.updateIRQ()
+}
+
+func (m *Mapper5) updateIRQ() {
+	m.console.SetMapperIRQ(m.irqPending && m.irqEnable || m.pcmIRQ && m.pcmIRQOn)
+}
+
+func (m *Mapper5) AudioOutput() float32 {
+	// PCM是8位，按DMC的权重混音
+	return pulseTable[m.pulseOutput(&m.pulse1)+m.pulseOutput(&m.pulse2)] + tndTable[m.pcm>>1]
+}
+
+// 和APU方波一样，只是没有扫描单元，周期小于8也不静音
+func (m *Mapper5) pulseOutput(p *Pulse) byte {
+	if !p.enabled || p.lengthValue == 0 || dutyTable[p.dutyMode][p.dutyValue] == 0 {
+		return 0
+	}
+	if p.envelopeEnable {
+		return p.envelopeVolume
+	}
+	return p.constVolume
+}
+
+// PPU当前在取背景还是精灵的数据，不在渲染时两个都是false
+func (m *Mapper5) fetching() (background, sprite bool) {
+	ppu := m.console.PPU
+	if ppu.flagShowBack == 0 && ppu.flagShowSprite == 0 {
+		return false, false
+	}
+	if ppu.ScanLine >= 240 && ppu.ScanLine != m.console.timing.preLine {
+		return false, false
+	}
+	if ppu.Cycle >= 257 && ppu.Cycle <= 320 {
+		return false, true
+	}
+	return true, false
+}
+
+// 分屏区域里返回这个tile在分屏中的行，不在分屏里返回-1
+func (m *Mapper5) splitLine() int {
+	if m.splitCtrl&0x80 == 0 || m.exMode > 1 {
+		return -1
+	}
+	ppu := m.console.PPU
+	// 321-336预取的是下一行的前两个tile，1-256取的是本行的第3-34个
+	line := ppu.ScanLine
+	var col int
+	if ppu.Cycle >= 321 {
+		col = (ppu.Cycle - 321) / 8
+		line++
+		if ppu.ScanLine == m.console.timing.preLine {
+			line = 0
+		}
+	} else {
+		col = (ppu.Cycle-1)/8 + 2
+	}
+	threshold := int(m.splitCtrl & 0x1F)
+	right := m.splitCtrl&0x40 != 0
+	if right != (col >= threshold) {
+		return -1
+	}
+	y := int(m.splitScroll) + line
+	if m.splitScroll < 240 {
+		y %= 240
+	}
+	return y & 0xFF
+}
+
+// 分屏时tile的列号
+func (m *Mapper5) splitColumn() int {
+	c := m.console.PPU.Cycle
+	if c >= 321 {
+		return (c - 321) / 8
+	}
+	return ((c-1)/8 + 2) & 0x1F
+}
+
+func (m *Mapper5) ReadNameTable(addr uint16) byte {
+	background, _ := m.fetching()
+	if background {
+		if y := m.splitLine(); y >= 0 {
+			col := m.splitColumn()
+			if addr&0x3FF < 0x3C0 {
+				return m.exRAM[(y/8)*32+col]
+			}
+			// 属性字节四个区域都填同一个调色板，PPU按自己的坐标取哪个都一样
+			at := m.exRAM[0x3C0+(y/32)*8+col/4]
+			shift := uint((y/16)&1)*4 + uint((col/2)&1)*2
+			return ((at >> shift) & 3) * 0x55
+		}
+		if m.exMode == 1 {
+			if addr&0x3FF < 0x3C0 {
+				m.exAttr = m.exRAM[addr&0x3FF]
+			} else {
+				m.NameTables.ReadNameTable(addr)
+				return (m.exAttr >> 6) * 0x55
+			}
+		}
+	}
+	return m.NameTables.ReadNameTable(addr)
+}
+
+func (m *Mapper5) Read(addr uint16) byte {
+	value := m.Peek(addr)
+	if addr < 0x6000 {
+		return value
+	}
+	if m.pcmRead && addr >= 0x8000 && addr < 0xC000 {
+		if value == 0 {
+			m.pcmIRQ = true
+			m.updateIRQ()
+		} else {
+			m.pcm = value
+		}
+	}
+	// 读NMI向量说明进入了vblank
+	if addr == 0xFFFA || addr == 0xFFFB {
+		m.inFrame = false
+		m.lastNT = 0
+		m.ntReads = 0
+	}
+	return value
+}
+
+// 不锁存PCM数据，也不检测NMI向量，给调试和跟踪用
+func (m *Mapper5) Peek(addr uint16) byte {
+	switch {
+	case addr < 0x2000:
+		return m.card.CHR[m.chrOffset(addr)]
+	case addr >= 0x6000:
+		slot := (addr - 0x6000) / 0x2000
+		offset := m.prgOffsets[slot] + int(addr%0x2000)
+		if m.prgRAM[slot] {
+			return m.card.SRAM[offset]
+		}
+		return m.card.PRG[offset]
+	}
+	return 0
+}
+
+func (m *Mapper5) PRGOffset(addr uint16) int {
+	if addr < 0x8000 {
+		return -1
+	}
+	slot := (addr - 0x6000) / 0x2000
+	if m.prgRAM[slot] {
+		return -1
+	}
+	return m.prgOffsets[slot] + int(addr%0x2000)
+}
+
+func (m *Mapper5) Write(addr uint16, value byte) {
+	switch {
+	case addr < 0x2000:
+		if m.card.HasCHRRAM() {
+			m.card.CHR[m.chrOffset(addr)] = value
+		}
+	case addr >= 0x6000:
+		slot := (addr - 0x6000) / 0x2000
+		if m.prgRAM[slot] && m.ramProtect[0] == 2 && m.ramProtect[1] == 1 {
+			m.card.SRAM[m.prgOffsets[slot]+int(addr%0x2000)] = value
+		}
+	}
+}
+
+// 取图案时按当前是背景/精灵、分屏、扩展属性选择CHR bank
+func (m *Mapper5) chrOffset(addr uint16) int {
+	background, sprite := m.fetching()
+	if background {
+		if y := m.splitLine(); y >= 0 {
+			// 分屏: 4KB bank，tile内的行换成分屏的行
+			offset := int(m.splitPage)*0x1000 + int(addr&0x0FF8) + y&7
+			return offset % len(m.card.CHR)
+		}
+		if m.exMode == 1 {
+			bank := int(m.chrUpper)<<6 | int(m.exAttr&0x3F)
+			return (bank*0x1000 + int(addr&0x0FFF)) % len(m.card.CHR)
+		}
+	}
+	bank := addr / 0x400
+	useB := m.lastChrB
+	if m.console.PPU.flagSpriteSize == 0 {
+		useB = false
+	} else if background || sprite {
+		useB = background
+	}
+	if useB {
+		return m.chrB[bank] + int(addr%0x400)
+	}
+	return m.chrA[bank] + int(addr%0x400)
+}
+
+func (m *Mapper5) ReadExpansion(addr uint16) (byte, bool) {
+	switch {
+	case addr == 0x5010:
+		value := byte(0)
+		if m.pcmIRQ {
+			value |= 0x80
+		}
+		if m.pcmRead {
+			value |= 1
+		}
+		m.pcmIRQ = false
+		m.updateIRQ()
+		return value, true
+	case addr == 0x5015:
+		value := byte(0)
+		if m.pulse1.lengthValue > 0 {
+			value |= 1
+		}
+		if m.pulse2.lengthValue > 0 {
+			value |= 2
+		}
+		return value, true
+	case addr == 0x5204:
+		value := byte(0)
+		if m.irqPending {
+			value |= 0x80
+		}
+		if m.inFrame {
+			value |= 0x40
+		}
+		m.irqPending = false
+		m.updateIRQ()
+		return value, true
+	case addr == 0x5205:
+		return byte(uint16(m.multiplicand) * uint16(m.multiplier)), true
+	case addr == 0x5206:
+		return byte(uint16(m.multiplicand) * uint16(m.multiplier) >> 8), true
+	case addr >= 0x5C00:
+		// 模式0/1的ExRAM只给PPU用，CPU读不到
+		if m.exMode >= 2 {
+			return m.exRAM[addr-0x5C00], true
+		}
+	}
+	return 0, false
+}
+
+func (m *Mapper5) WriteExpansion(addr uint16, value byte) {
+	switch {
+	case addr >= 0x5000 && addr <= 0x5007:
+		p := &m.pulse1
+		if addr >= 0x5004 {
+			p = &m.pulse2
+		}
+		switch addr & 3 {
+		case 0:
+			p.writeCtrl(value)
+		case 2:
+			p.writeTimerLow(value)
+		case 3:
+			p.writeTimerHigh(value)
+			if p.enabled {
+				p.writeLength(value)
+			}
+		}
+	case addr == 0x5010:
+		m.pcmRead = value&1 != 0
+		m.pcmIRQOn = value&0x80 != 0
+		m.updateIRQ()
+	case addr == 0x5011:
+		// 写模式下写0无效
+		if !m.pcmRead && value != 0 {
+			m.pcm = value
+		}
+	case addr == 0x5015:
+		m.pulse1.enabled = value&1 != 0
+		m.pulse2.enabled = value&2 != 0
+		if !m.pulse1.enabled {
+			m.pulse1.lengthValue = 0
+		}
+		if !m.pulse2.enabled {
+			m.pulse2.lengthValue = 0
+		}
+	case addr == 0x5100:
+		m.prgMode = value & 3
+		m.updatePRG()
+	case addr == 0x5101:
+		m.chrMode = value & 3
+		m.updateCHR()
+	case addr == 0x5102 || addr == 0x5103:
+		m.ramProtect[addr-0x5102] = value & 3
+	case addr == 0x5104:
+		m.exMode = value & 3
+		m.updateNameTables()
+	case addr == 0x5105:
+		m.ntMapping = value
+		m.updateNameTables()
+	case addr == 0x5106:
+		m.fillTile = value
+		m.updateFill()
+	case addr == 0x5107:
+		m.fillColor = value & 3
+		m.updateFill()
+	case addr >= 0x5113 && addr <= 0x5117:
+		m.prgRegs[addr-0x5113] = value
+		m.updatePRG()
+	case addr >= 0x5120 && addr <= 0x512B:
+		m.chrRegs[addr-0x5120] = uint16(m.chrUpper)<<8 | uint16(value)
+		m.lastChrB = addr >= 0x5128
+		m.updateCHR()
+	case addr == 0x5130:
+		m.chrUpper = value & 3
+	case addr == 0x5200:
+		m.splitCtrl = value
+	case addr == 0x5201:
+		m.splitScroll = value
+	case addr == 0x5202:
+		m.splitPage = value
+	case addr == 0x5203:
+		m.irqCompare = value
+	case addr == 0x5204:
+		m.irqEnable = value&0x80 != 0
+		m.updateIRQ()
+	case addr == 0x5205:
+		m.multiplicand = value
+	case addr == 0x5206:
+		m.multiplier = value
+	case addr >= 0x5C00:
+		switch m.exMode {
+		case 0, 1:
+			// 不在渲染时写入的是0
+			if !m.inFrame {
+				value = 0
+			}
+			m.exRAM[addr-0x5C00] = value
+		case 2:
+			m.exRAM[addr-0x5C00] = value
+		}
+	}
+}
+
+// $6000-$FFFF每8KB的来源，bank号按8KB算，bit 7为1是ROM
+func (m *Mapper5) updatePRG() {
+	r := m.prgRegs
+	m.setPRG(0, r[0]&0x7F)
+	switch m.prgMode {
+	case 0:
+		for i := 1; i <= 4; i++ {
+			m.setPRG(i, r[4]&0xFC|byte(i-1)|0x80)
+		}
+	case 1:
+		m.setPRG(1, r[2]&0xFE)
+		m.setPRG(2, r[2]|0x01)
+		m.setPRG(3, r[4]&0xFE|0x80)
+		m.setPRG(4, r[4]|0x81)
+	case 2:
+		m.setPRG(1, r[2]&0xFE)
+		m.setPRG(2, r[2]|0x01)
+		m.setPRG(3, r[3])
+		m.setPRG(4, r[4]|0x80)
+	case 3:
+		m.setPRG(1, r[1])
+		m.setPRG(2, r[2])
+		m.setPRG(3, r[3])
+		m.setPRG(4, r[4]|0x80)
+	}
+}
+
+func (m *Mapper5) setPRG(slot int, value byte) {
+	m.prgRAM[slot] = value&0x80 == 0
+	if m.prgRAM[slot] {
+		count := len(m.card.SRAM) / 0x2000
+		m.prgOffsets[slot] = int(value&7) % count * 0x2000
+	} else {
+		count := len(m.card.PRG) / 0x2000
+		m.prgOffsets[slot] = int(value&0x7F) % count * 0x2000
+	}
+}
+
+func (m *Mapper5) updateCHR() {
+	r := m.chrRegs
+	for i := 0; i < 8; i++ {
+		var a, b int
+		switch m.chrMode {
+		case 0:
+			a = int(r[7])*8 + i
+			b = int(r[11])*8 + i
+		case 1:
+			a = int(r[3+i/4*4])*4 + i%4
+			b = int(r[11])*4 + i%4
+		case 2:
+			a = int(r[i/2*2+1])*2 + i%2
+			b = int(r[9+i/2%2*2])*2 + i%2
+		case 3:
+			a = int(r[i])
+			b = int(r[8+i%4])
+		}
+		count := len(m.card.CHR) / 0x400
+		m.chrA[i] = a % count * 0x400
+		m.chrB[i] = b % count * 0x400
+	}
+}
+
+// $5105每2位选一个槽: 0/1 CIRAM 2 ExRAM 3 填充模式
+func (m *Mapper5) updateNameTables() {
+	for slot := 0; slot < 4; slot++ {
+		switch source := (m.ntMapping >> (slot * 2)) & 3; source {
+		case 0, 1:
+			m.Map(slot, m.console.CIRAM(int(source)), true)
+		case 2:
+			if m.exMode <= 1 {
+				m.Map(slot, m.exRAM[:], true)
+			} else {
+				m.Map(slot, m.zero[:], false)
+			}
+		case 3:
+			m.Map(slot, m.fill[:], false)
+		}
+	}
+}
+
+func (m *Mapper5) updateFill() {
+	for i := 0; i < 0x3C0; i++ {
+		m.fill[i] = m.fillTile
+	}
+	for i := 0x3C0; i < 0x400; i++ {
+		m.fill[i] = m.fillColor * 0x55
+	}
+}
+
+func (m *Mapper5) Serialize(s *Serializer) {
+	s.Byte(&m.prgMode)
+	s.Byte(&m.chrMode)
+	s.Bytes(m.ramProtect[:])
+	s.Byte(&m.exMode)
+	s.Byte(&m.ntMapping)
+	s.Byte(&m.fillTile)
+	s.Byte(&m.fillColor)
+	s.Bytes(m.prgRegs[:])
+	for i := range m.chrRegs {
+		s.Uint16(&m.chrRegs[i])
+	}
+	s.Byte(&m.chrUpper)
+	s.Bool(&m.lastChrB)
+	s.Bytes(m.exRAM[:])
+	s.Byte(&m.splitCtrl)
+	s.Byte(&m.splitScroll)
+	s.Byte(&m.splitPage)
+	s.Byte(&m.exAttr)
+	s.Byte(&m.irqCompare)
+	s.Bool(&m.irqEnable)
+	s.Bool(&m.irqPending)
+	s.Bool(&m.inFrame)
+	s.Byte(&m.scanline)
+	s.Uint16(&m.lastNT)
+	s.Int(&m.ntReads)
+	s.Int(&m.ppuIdle)
+	s.Byte(&m.multiplicand)
+	s.Byte(&m.multiplier)
+	m.pulse1.serialize(s)
+	m.pulse2.serialize(s)
+	s.Byte(&m.pcm)
+	s.Bool(&m.pcmRead)
+	s.Bool(&m.pcmIRQOn)
+	s.Bool(&m.pcmIRQ)
+	s.Int(&m.audioTick)
+	s.Float64(&m.frameTick)
+	if s.Loading() {
+		m.updatePRG()
+		m.updateCHR()
+		m.updateFill()
+		m.updateNameTables()
+	}
+}
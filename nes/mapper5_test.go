@@ -0,0 +1,334 @@
+package nes
+
+import (
+	"testing"
+)
+
+// 128KB PRG，16KB CHR，64KB PRG RAM，复位后打开渲染然后死循环
+func mapper5ROM() []byte {
+	rom := testROM(5, 0, 0x20000, 0x4000, []byte{
+		0xA9, 0x18, 0x8D, 0x01, 0x20, // LDA #$18; STA $2001
+		0x4C, 0x15, 0xE0, //             JMP $E015
+	})
+	rom[10] = 0x0A // 64 << 10
+	return rom
+}
+
+func TestMapper5Banking(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	check := func(addr uint16, want byte) {
+		t.Helper()
+		if v := cpu.Read(addr); v != want {
+			t.Errorf("$%04X = %d, want %d", addr, v, want)
+		}
+	}
+	check(0xE000, 15)
+
+	cpu.Write(0x5100, 3)
+	cpu.Write(0x5114, 0x83)
+	check(0x8000, 3)
+
+	cpu.Write(0x5100, 0)
+	cpu.Write(0x5117, 0x85)
+	check(0x8000, 4)
+	check(0xE000, 7)
+
+	cpu.Write(0x5100, 1)
+	cpu.Write(0x5115, 0x86)
+	cpu.Write(0x5117, 0x8F)
+	check(0xA000, 7)
+	check(0xC000, 14)
+
+	// PRG RAM: 写保护解开之后才能写
+	cpu.Write(0x5113, 1)
+	cpu.Write(0x6000, 0x55)
+	check(0x6000, 0)
+	cpu.Write(0x5102, 2)
+	cpu.Write(0x5103, 1)
+	cpu.Write(0x6000, 0x55)
+	cpu.Write(0x5113, 0)
+	check(0x6000, 0)
+	cpu.Write(0x5113, 1)
+	check(0x6000, 0x55)
+
+	cpu.Write(0x5205, 200)
+	cpu.Write(0x5206, 100)
+	check(0x5205, 20000&0xFF)
+	check(0x5206, 20000>>8)
+}
+
+// iNES头部没有RAM大小时按64KB给，NES 2.0按头部
+func TestMapper5RAMSize(t *testing.T) {
+	ines := inesROM(5, 0x20000, 0x4000, nil)
+	nes2 := mapper5ROM()
+	nes2[10] = 0x07 // 8KB
+	for _, c := range []struct {
+		rom  []byte
+		size int
+	}{{ines, 0x10000}, {nes2, 0x2000}} {
+		console, err := NewConsole(c.rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := len(console.Card.SRAM); n != c.size || console.Card.PRGRAMSize != c.size {
+			t.Errorf("NES2 %v: SRAM %d bytes, PRG RAM size %d, want %d", console.Card.NES2, n, console.Card.PRGRAMSize, c.size)
+		}
+		cpu := console.CPU.Memory
+		cpu.Write(0x5102, 2)
+		cpu.Write(0x5103, 1)
+		cpu.Write(0x5113, 7)
+		cpu.Write(0x6000, 0x77)
+		if v := console.Card.SRAM[(7*0x2000)%c.size]; v != 0x77 {
+			t.Errorf("NES2 %v: bank 7 write landed elsewhere (%02X)", console.Card.NES2, v)
+		}
+	}
+}
+
+func TestMapper5FillMode(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x5105, 0xC4) // 0: CIRAM0 1: CIRAM1 2: CIRAM0 3: 填充
+	cpu.Write(0x5106, 0x42)
+	cpu.Write(0x5107, 2)
+	ppu := console.PPU.Memory
+	ppu.Write(0x2000, 7)
+	if v := ppu.Read(0x2800); v != 7 {
+		t.Errorf("$2800 = %d, want 7", v)
+	}
+	if v := ppu.Read(0x2C10); v != 0x42 {
+		t.Errorf("fill tile = %02X, want 42", v)
+	}
+	if v := ppu.Read(0x2FC0); v != 0xAA {
+		t.Errorf("fill attribute = %02X, want AA", v)
+	}
+}
+
+func TestMapper5ScanlineIRQ(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x5203, 100)
+	cpu.Write(0x5204, 0x80)
+	for _, cycleAccurate := range []bool{false, true} {
+		console.SetCycleAccurate(cycleAccurate)
+		var lines []int
+		for len(lines) < 2 && console.PPU.Frame < 10 {
+			console.Step()
+			if console.CPU.IRQ(IRQMapper) {
+				lines = append(lines, console.PPU.ScanLine)
+				if v := cpu.Read(0x5204); v != 0xC0 {
+					t.Errorf("$5204 = %02X, want C0", v)
+				}
+			}
+		}
+		if len(lines) != 2 || lines[0] != 100 || lines[1] != 100 {
+			t.Errorf("cycle %v: irq lines %v, want line 100 each frame", cycleAccurate, lines)
+		}
+	}
+}
+
+// 把PPU放到某条扫描线的某个点上，打开渲染
+func mapper5At(console *Console, scanLine, cycle int) *Mapper5 {
+	console.PPU.ScanLine = scanLine
+	console.PPU.Cycle = cycle
+	return console.Mapper.(*Mapper5)
+}
+
+func TestMapper5Split(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x2001, 0x18)
+	// 模式2下CPU才能写ExRAM，写完换回模式0
+	cpu.Write(0x5104, 2)
+	cpu.Write(0x5C00+3*32+5, 0x42) // 第3行第5列的tile
+	cpu.Write(0x5C00+3*32+1, 0x43)
+	cpu.Write(0x5C00+0x3C1, 0x20) // 第1个属性字节，右下区域是调色板2
+	cpu.Write(0x5104, 0)
+	console.PPU.Memory.Write(0x2000+3*32+5, 0x11)
+	cpu.Write(0x5200, 0x80|10) // 左侧10列是分屏
+	cpu.Write(0x5201, 20)
+	cpu.Write(0x5202, 2)
+
+	// 第6行，分屏里的y是26: tile第3行，tile内第2行；点25取的是第5列
+	m := mapper5At(console, 6, 25)
+	if v := m.ReadNameTable(0x2000 + 3*32 + 5); v != 0x42 {
+		t.Errorf("split tile %02X, want 42", v)
+	}
+	if v := m.ReadNameTable(0x23C0); v != 0xAA {
+		t.Errorf("split attribute %02X, want AA", v)
+	}
+	// 分屏用$5202选的4KB bank，tile内的行换成分屏的行
+	if v := m.Read(0x0420 | 5); v != 9<<3|2 {
+		t.Errorf("split chr %02X, want %02X", v, 9<<3|2)
+	}
+	// 第12列在分屏外面
+	m = mapper5At(console, 6, 81)
+	if v := m.ReadNameTable(0x2000 + 3*32 + 5); v != 0x11 {
+		t.Errorf("tile outside split %02X, want 11", v)
+	}
+	// CHR寄存器都是0，每个1KB都是bank 0
+	if v := m.Read(0x0420 | 5); v != 5 {
+		t.Errorf("chr outside split %02X, want 05", v)
+	}
+	// 预取的是下一行的前两列
+	m = mapper5At(console, 5, 329)
+	if v := m.ReadNameTable(0x2000 + 3*32 + 1); v != 0x43 {
+		t.Errorf("prefetched split tile %02X, want 43", v)
+	}
+}
+
+func TestMapper5ExtendedAttributes(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	cpu.Write(0x2001, 0x18)
+	cpu.Write(0x5104, 2)
+	cpu.Write(0x5C00+7, 0x82) // 调色板2，4KB bank 2
+	cpu.Write(0x5104, 1)
+	m := mapper5At(console, 10, 9)
+	m.ReadNameTable(0x2007)
+	if v := m.ReadNameTable(0x23C1); v != 0xAA {
+		t.Errorf("extended attribute %02X, want AA", v)
+	}
+	// 4KB bank 2是第8个1KB bank
+	if v := m.Read(0x0013); v != 8<<3|3 {
+		t.Errorf("extended chr %02X, want %02X", v, 8<<3|3)
+	}
+	// 精灵不受扩展属性影响
+	m = mapper5At(console, 10, 260)
+	if v := m.Read(0x0013); v != 3 {
+		t.Errorf("sprite chr %02X, want 03", v)
+	}
+}
+
+// 8x16精灵时精灵用$5120-$5127，背景用$5128-$512B
+func TestMapper5SpriteCHR(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	for i := uint16(0); i < 8; i++ {
+		cpu.Write(0x5120+i, byte(8+i))
+	}
+	for i := uint16(0); i < 4; i++ {
+		cpu.Write(0x5128+i, byte(4+i))
+	}
+	check := func(name string, want byte) {
+		t.Helper()
+		if v := console.Mapper.Read(0x0400); v != want<<3 {
+			t.Errorf("%s: chr bank %d, want %d", name, v>>3, want)
+		}
+	}
+	cpu.Write(0x2000, 0x20)
+	// 不渲染时用最后写的那一组
+	check("idle after B", 5)
+	cpu.Write(0x5127, 15)
+	check("idle after A", 9)
+
+	cpu.Write(0x2001, 0x18)
+	mapper5At(console, 10, 260)
+	check("sprite", 9)
+	mapper5At(console, 10, 9)
+	check("background", 5)
+	cpu.Write(0x2000, 0)
+	check("8x8 background", 9)
+}
+
+func TestMapper5Audio(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cpu := console.CPU.Memory
+	m := console.Mapper.(*Mapper5)
+	cpu.Write(0x5015, 0x01)
+	cpu.Write(0x5000, 0xBF) // 占空比50%，固定音量15
+	cpu.Write(0x5002, 0x10)
+	cpu.Write(0x5003, 0x08)
+	if v := cpu.Read(0x5015); v != 0x01 {
+		t.Errorf("$5015 = %02X, want 01", v)
+	}
+	low, high := float32(1), float32(0)
+	for i := 0; i < 200; i++ {
+		m.ClockCPU()
+		out := m.AudioOutput()
+		if out < low {
+			low = out
+		}
+		if out > high {
+			high = out
+		}
+	}
+	if low != 0 || high != pulseTable[15] {
+		t.Errorf("pulse output %v-%v, want 0-%v", low, high, pulseTable[15])
+	}
+	cpu.Write(0x5015, 0)
+	if v := cpu.Read(0x5015); v != 0 {
+		t.Errorf("$5015 = %02X after disable, want 00", v)
+	}
+
+	// PCM写模式，按DMC的权重输出
+	cpu.Write(0x5011, 0x80)
+	if v := m.AudioOutput(); v != tndTable[0x40] {
+		t.Errorf("pcm output %v, want %v", v, tndTable[0x40])
+	}
+	// 读模式: CPU从$8000-$BFFF读到的数据就是采样，读到0时IRQ
+	cpu.Write(0x5114, 0x83)
+	cpu.Write(0x5010, 0x81)
+	cpu.Read(0x8000)
+	if m.pcm != 3 {
+		t.Errorf("pcm %d after reading $8000, want 3", m.pcm)
+	}
+	cpu.Read(0x8001)
+	if !console.CPU.IRQ(IRQMapper) {
+		t.Error("no irq after reading 0")
+	}
+	if v := cpu.Read(0x5010); v != 0x81 {
+		t.Errorf("$5010 = %02X, want 81", v)
+	}
+	if console.CPU.IRQ(IRQMapper) {
+		t.Error("irq not acknowledged by reading $5010")
+	}
+}
+
+// 跟踪器的Peek不能锁存PCM数据、触发IRQ，也不能把NMI向量当成进入vblank
+func TestMapper5Peek(t *testing.T) {
+	console, err := NewConsole(mapper5ROM())
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := console.CPU.Memory.(*CPUMemory)
+	m := console.Mapper.(*Mapper5)
+	mem.Write(0x5114, 0x83)
+	mem.Write(0x5010, 0x81)
+	m.inFrame = true
+	for _, addr := range []uint16{0x8000, 0x8001, 0xFFFA, 0xFFFB} {
+		if v, want := mem.Peek(addr), m.Peek(addr); v != want {
+			t.Errorf("Peek(%04X) = %02X, want %02X", addr, v, want)
+		}
+	}
+	if console.CPU.IRQ(IRQMapper) {
+		t.Error("peek in pcm read mode raised irq")
+	}
+	if m.pcm != 0 {
+		t.Errorf("pcm %d after peek, want 0", m.pcm)
+	}
+	if !m.inFrame {
+		t.Error("peeking the nmi vector left the frame")
+	}
+}
@@ -0,0 +1,208 @@
+package nes
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestMappersSorted(t *testing.T) {
+	list := Mappers()
+	for i, want := range []uint16{0, 1, 2, 3, 4, 5} {
+		if i >= len(list) || list[i].Number != want {
+			t.Fatalf("Mappers() = %v, want 0-5 first", list)
+		}
+	}
+}
+
+func TestRegisterMapper(t *testing.T) {
+	rom := testROM(15, 0, 0x4000, 0x2000, loopProg)
+	if _, err := NewConsole(rom); !errors.Is(err, ErrUnsupportedMapper) {
+		t.Fatalf("err = %v, want ErrUnsupportedMapper", err)
+	}
+
+	RegisterMapper(MapperInfo{Number: 15, SubMappers: []byte{0}, Name: "test", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		return NewMapper0(card), nil
+	}})
+	defer func() {
+		mappersLock.Lock()
+		delete(mappers, 15)
+		mappersLock.Unlock()
+	}()
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := console.RunFrames(2, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// MMC3: 背景用$0000，精灵用$1000，每条扫描线取精灵图案时A12上升一次
+func TestMapper4ScanlineIRQ(t *testing.T) {
+	console, err := NewConsole(testROM(4, 0, 0x8000, 0x2000, []byte{
+		0xA9, 0x08, 0x8D, 0x00, 0x20, // LDA #$08; STA $2000
+		0xA9, 0x18, 0x8D, 0x01, 0x20, // LDA #$18; STA $2001
+		0xA9, 0x0A, 0x8D, 0x00, 0xC0, // LDA #10;  STA $C000
+		0x8D, 0x01, 0xC0, //             STA $C001
+		0x8D, 0x01, 0xE0, //             STA $E001
+		0x4C, 0x25, 0xE0, //             JMP $E025
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, cycleAccurate := range []bool{false, true} {
+		console.SetCycleAccurate(cycleAccurate)
+		console.Reset()
+		var lines []int
+		for len(lines) < 3 && console.PPU.Frame < 5 {
+			console.Step()
+			if console.CPU.IRQ(IRQMapper) {
+				ppu := console.PPU
+				if ppu.Cycle < 261 || ppu.Cycle > 280 {
+					t.Errorf("irq at dot %d", ppu.Cycle)
+				}
+				lines = append(lines, ppu.ScanLine)
+				// 确认IRQ然后重新打开
+				console.Mapper.Write(0xE000, 0)
+				console.Mapper.Write(0xE001, 0)
+			}
+		}
+		if len(lines) < 3 {
+			t.Fatalf("cycle %v: irq lines %v", cycleAccurate, lines)
+		}
+		// 装载10之后再减10次，11条扫描线一次
+		if lines[1]-lines[0] != 11 || lines[2]-lines[1] != 11 {
+			t.Errorf("cycle %v: irq lines %v, want every 11 lines", cycleAccurate, lines)
+		}
+	}
+}
+
+/*
+对应blargg mmc3_test_2的各个单项(rom不在仓库里):
+关掉渲染，通过$2006把地址放到PPU总线上给计数器打时钟，每次上升沿之前A12保持低电平low个CPU时钟
+*/
+type mmc3Clocker struct {
+	console *Console
+	m       *Mapper4
+}
+
+func newMMC3Clocker(t *testing.T, subMapper byte) *mmc3Clocker {
+	console, err := NewConsole(testROM(4, subMapper, 0x8000, 0x2000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &mmc3Clocker{console, console.Mapper.(*Mapper4)}
+}
+
+func (c *mmc3Clocker) write(addr uint16, value byte) {
+	c.console.CPU.Memory.Write(addr, value)
+}
+
+func (c *mmc3Clocker) setAddress(addr uint16) {
+	c.write(0x2006, byte(addr>>8))
+	c.write(0x2006, byte(addr))
+}
+
+// A12先拉低low个CPU时钟再拉高，返回之后是否有IRQ
+func (c *mmc3Clocker) clock(low int) bool {
+	c.setAddress(0x0000)
+	for i := 0; i < low; i++ {
+		c.m.ClockCPU()
+	}
+	c.setAddress(0x1000)
+	return c.console.CPU.IRQ(IRQMapper)
+}
+
+// 打n次时钟，返回第几次(从1开始)出现IRQ，每次出现后确认并重新打开
+func (c *mmc3Clocker) irqs(n int) []int {
+	var at []int
+	for i := 1; i <= n; i++ {
+		if c.clock(3) {
+			at = append(at, i)
+			c.write(0xE000, 0)
+			c.write(0xE001, 0)
+		}
+	}
+	return at
+}
+
+func TestMMC3Clocking(t *testing.T) {
+	c := newMMC3Clocker(t, 0)
+	c.write(0xC000, 10)
+	c.write(0xC001, 0)
+	c.write(0xE001, 0)
+	// 第1次装载10，之后减10次到0
+	if got := c.irqs(23); fmt.Sprint(got) != "[11 22]" {
+		t.Errorf("irqs at %v, want [11 22]", got)
+	}
+	// A12低电平不够3个CPU时钟时上升沿被滤掉
+	c.write(0xC001, 0)
+	c.clock(3)
+	for low := 0; low < 3; low++ {
+		c.clock(low)
+	}
+	if c.m.timerValue != 10 {
+		t.Errorf("counter %d after filtered edges, want 10", c.m.timerValue)
+	}
+	// 关闭IRQ时照样计数，只是不发出请求
+	c.write(0xE000, 0)
+	for i := 0; i < 10; i++ {
+		if c.clock(3) {
+			t.Fatalf("irq while disabled")
+		}
+	}
+	if c.m.timerValue != 0 {
+		t.Errorf("counter %d, want 0", c.m.timerValue)
+	}
+}
+
+func TestMMC3Details(t *testing.T) {
+	c := newMMC3Clocker(t, 0)
+	c.write(0xC000, 5)
+	c.write(0xC001, 0)
+	c.write(0xE001, 0)
+	c.clock(3)
+	// 计数器不为0时改$C000不影响当前计数，下次装载才用新值
+	c.write(0xC000, 2)
+	if got := c.irqs(9); fmt.Sprint(got) != "[5 8]" {
+		t.Errorf("irqs at %v, want [5 8]", got)
+	}
+	// $C001把计数器清零，下一次时钟重新装载
+	c.clock(3)
+	c.write(0xC000, 3)
+	c.write(0xC001, 0)
+	if got := c.irqs(4); fmt.Sprint(got) != "[4]" {
+		t.Errorf("irqs at %v after reload, want [4]", got)
+	}
+	// $E000确认IRQ
+	c.write(0xC000, 1)
+	c.write(0xC001, 0)
+	c.clock(3)
+	if !c.clock(3) {
+		t.Fatal("no irq")
+	}
+	c.write(0xE000, 0)
+	if c.console.CPU.IRQ(IRQMapper) {
+		t.Error("irq not acknowledged by $E000")
+	}
+}
+
+// 装载值为0: 新版MMC3每次时钟都有IRQ，MMC3A(子mapper 4)只有写$C001之后的那一次有
+func TestMMC3ReloadZero(t *testing.T) {
+	for _, tt := range []struct {
+		subMapper byte
+		want      string
+	}{
+		{0, "[1 2 3 4]"},
+		{4, "[1]"},
+	} {
+		c := newMMC3Clocker(t, tt.subMapper)
+		c.write(0xC000, 0)
+		c.write(0xC001, 0)
+		c.write(0xE001, 0)
+		if got := c.irqs(4); fmt.Sprint(got) != tt.want {
+			t.Errorf("submapper %d: irqs at %v, want %s", tt.subMapper, got, tt.want)
+		}
+	}
+}
@@ -16,39 +16,63 @@ type Memory interface {
 type CPUMemory struct {
 	RAM     []byte
 	console *Console
+	bus     byte // 数据总线上最后的值，读没有映射的地址时返回它(open bus)
 }
 
 func NewCPUMemory(console *Console) Memory {
-	ram := make([]byte, 0x2000)
-	return &CPUMemory{console: console, RAM: ram}
+	// 和console共用2KB内部RAM
+	return &CPUMemory{console: console, RAM: console.RAM}
 }
 
 func (mem *CPUMemory) Read(addr uint16) byte {
+	// 只写寄存器和没有映射的地址保持总线上的值
+	value := mem.bus
 	switch {
 	case addr < 0x2000:
-		return mem.RAM[addr%0x0800]
+		value = mem.RAM[addr%0x0800]
 	case addr < 0x4000:
 		// 这边addr访问ppu寄存器，存在镜像，需要对8取余
-		return mem.console.PPU.readRegister(0x2000 + addr%8)
-	case addr == 0x4014:
-		return mem.console.PPU.readRegister(addr)
+		value = mem.console.PPU.readRegister(0x2000 + addr%8)
 	case addr == 0x4015:
-		return mem.console.APU.ReadRegister(addr)
+		// $4015是APU内部寄存器，不驱动数据总线，bit 5是总线上的值
+		return mem.console.APU.ReadRegister(addr) | mem.bus&0x20
 	case addr == 0x4016:
-		return mem.console.Controller1.Read()
+		// 手柄只驱动低几位，高3位是总线上的值
+		value = mem.console.Controller1.Read() | mem.bus&0xe0
 	case addr == 0x4017:
-		return mem.console.Controller2.Read()
-	case addr < 0x6000:
-		// TODO
-		return 0
+		value = mem.console.Controller2.Read() | mem.bus&0xe0
+	case addr >= 0x6000:
+		value = mem.console.Mapper.Read(addr)
+	case addr >= 0x4020:
+		if ex := mem.console.expansion; ex != nil {
+			if v, ok := ex.ReadExpansion(addr); ok {
+				value = v
+			}
+		}
+	}
+	mem.bus = value
+	return value
+}
+
+// 不改变任何状态的读取，给调试和跟踪用
+// 寄存器区域读取会有副作用(清标志、手柄移位等)，和nestest.log一样显示FF
+func (mem *CPUMemory) Peek(addr uint16) byte {
+	switch {
+	case addr < 0x2000:
+		return mem.RAM[addr%0x0800]
+	case addr < 0x4020:
+		return 0xff
 	case addr >= 0x6000:
+		if m, ok := mem.console.Mapper.(PeekMapper); ok {
+			return m.Peek(addr)
+		}
 		return mem.console.Mapper.Read(addr)
-	default:
-		return 0
 	}
+	return 0
 }
 
 func (mem *CPUMemory) Write(addr uint16, value byte) {
+	mem.bus = value
 	switch {
 	case addr < 0x2000:
 		mem.RAM[addr%0x0800] = value
@@ -66,7 +90,9 @@ func (mem *CPUMemory) Write(addr uint16, value byte) {
 	case addr == 0x4017:
 		mem.console.APU.writeRegister(addr, value)
 	case addr < 0x6000:
-		// TODO IO寄存器？
+		if ex := mem.console.expansion; ex != nil && addr >= 0x4020 {
+			ex.WriteExpansion(addr, value)
+		}
 	case addr >= 0x6000:
 		mem.console.Mapper.Write(addr, value)
 	default:
@@ -87,13 +113,16 @@ func (mem *PPUMemory) Read(addr uint16) byte {
 	// 高于0x3fff的会被镜像，所以需要对0x4000取余；
 
 	addr = addr % 0x4000
+	mem.console.ppuAddress(addr)
 	switch {
 	// 0-0x2000是pattern table图样表，这部分来自卡带的CHR-ROM，除了这部分，其他的都是PPU自己的内存（读+写）
 	case addr < 0x2000:
 		return mem.console.Mapper.Read(addr)
 	case addr < 0x3f00:
-		mode := mem.console.Card.Mirror
-		return mem.console.PPU.NameTable[MirrorAddress(mode, addr)%2048]
+		if nt := mem.console.nameTables; nt != nil {
+			return nt.ReadNameTable(addr)
+		}
+		return *mem.nameTable(addr)
 	case addr < 0x4000:
 		return mem.console.PPU.ReadPalette(addr % 32)
 	default:
@@ -103,13 +132,17 @@ func (mem *PPUMemory) Read(addr uint16) byte {
 
 func (mem *PPUMemory) Write(addr uint16, value byte) {
 	addr = addr % 0x4000
+	mem.console.ppuAddress(addr)
 	switch {
 	// 0-0x2000是pattern table图样表，这部分来自卡带的CHR-ROM，除了这部分，其他的都是PPU自己的内存（读+写）
 	case addr < 0x2000:
 		mem.console.Mapper.Write(addr, value)
 	case addr < 0x3f00:
-		mode := mem.console.Card.Mirror
-		mem.console.PPU.NameTable[MirrorAddress(mode, addr)%2048] = value
+		if nt := mem.console.nameTables; nt != nil {
+			nt.WriteNameTable(addr, value)
+			return
+		}
+		*mem.nameTable(addr) = value
 	case addr < 0x4000:
 		mem.console.PPU.WritePalette(addr%32, value)
 	default:
@@ -117,6 +150,16 @@ func (mem *PPUMemory) Write(addr uint16, value byte) {
 	}
 }
 
+// 按卡带的镜像方式找到名称表地址对应的内存，四屏时后两个表在卡带的显存上
+func (mem *PPUMemory) nameTable(addr uint16) *byte {
+	card := mem.console.Card
+	index := MirrorAddress(card.Mirror, addr) - 0x2000
+	if index >= 2048 && len(card.VRAM) >= 2048 {
+		return &card.VRAM[index-2048]
+	}
+	return &mem.console.PPU.NameTable[index%2048]
+}
+
 // Mirroring Modes
 // 这里直接用开源的这部分代码，镜像模式的各种类型，一般常用的是 MirrorHorizontal、MirrorVertical
 
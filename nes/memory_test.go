@@ -0,0 +1,66 @@
+package nes
+
+import (
+	"testing"
+)
+
+// 只写寄存器和没有映射的地址返回总线上最后的值
+func TestOpenBus(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, []byte{
+		0xAD, 0x16, 0x40, // LDA $4016
+		0x85, 0x00, //       STA $00
+		0xAD, 0x00, 0x50, // LDA $5000
+		0x85, 0x01, //       STA $01
+		0x4C, 0x1A, 0xE0, // JMP $E01A
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for console.CPU.PC != 0xE01A {
+		console.Step()
+	}
+	// 读之前总线上是地址的高字节
+	if v := console.RAM[0] & 0xE0; v != 0x40 {
+		t.Errorf("LDA $4016 bits 5-7 = %02X, want 40", v)
+	}
+	if v := console.RAM[1]; v != 0x50 {
+		t.Errorf("LDA $5000 = %02X, want 50", v)
+	}
+
+	mem := console.CPU.Memory
+	mem.Write(0x2001, 0xA5)
+	if v := mem.Read(0x2001); v != 0xA5 {
+		t.Errorf("$2001 = %02X, want last written A5", v)
+	}
+	if v := mem.Read(0x2002) & 0x1F; v != 0x05 {
+		t.Errorf("$2002 bits 0-4 = %02X, want 05 from the latch", v)
+	}
+	console.RAM[2] = 0xA0
+	mem.Read(0x0002)
+	if v := mem.Read(0x4016) & 0xE0; v != 0xA0 {
+		t.Errorf("$4016 bits 5-7 = %02X, want A0 from the bus", v)
+	}
+}
+
+// PPU的I/O锁存器每一位单独计时，36帧没有刷新就衰减为0
+func TestPPUOpenBusDecay(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, idleProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ppu := console.PPU
+	mem := console.CPU.Memory
+	mem.Write(0x2003, 0xFF)
+	start := ppu.Frame
+	ppu.Frame = start + 20
+	ppu.nmiOccurred = true
+	status := mem.Read(0x2002) // 只刷新bit 5-7，bit 7是vblank
+	ppu.Frame = start + ppuBusDecayFrames
+	if v, want := mem.Read(0x2001), 0x1F|status&0xE0; v != want {
+		t.Errorf("latch %02X after %d frames, want %02X", v, ppuBusDecayFrames, want)
+	}
+	ppu.Frame = start + ppuBusDecayFrames + 1
+	if v, want := mem.Read(0x2001), status&0xE0; v != want {
+		t.Errorf("latch %02X after %d frames, want %02X", v, ppuBusDecayFrames+1, want)
+	}
+}
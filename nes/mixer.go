@@ -0,0 +1,89 @@
+package nes
+
+import (
+	"fmt"
+)
+
+// APU的五个声道，加上卡带的扩展音源
+const (
+	ChannelPulse1 = iota
+	ChannelPulse2
+	ChannelTriangle
+	ChannelNoise
+	ChannelDMC
+	ChannelExpansion
+	ChannelCount
+)
+
+var channelNames = [ChannelCount]string{"pulse1", "pulse2", "triangle", "noise", "dmc", "expansion"}
+
+func ChannelName(channel int) string {
+	if channel >= 0 && channel < ChannelCount {
+		return channelNames[channel]
+	}
+	return fmt.Sprintf("channel%d", channel)
+}
+
+// 单个声道的混音设置
+type ChannelMix struct {
+	Muted  bool
+	Solo   bool    // 有声道独奏时只输出独奏的声道
+	Volume float32 // 音量倍数，1为原始音量
+	Pan    float32 // 声像，-1最左，0居中，1最右，只在立体声输出时有效
+}
+
+type Mixer [ChannelCount]ChannelMix
+
+// 所有声道原样输出
+func DefaultMixer() Mixer {
+	var m Mixer
+	for i := range m {
+		m[i].Volume = 1
+	}
+	return m
+}
+
+// 和默认设置一样时直接查表，结果和真机的非线性混音完全一致
+func (m *Mixer) isDefault() bool {
+	return *m == DefaultMixer()
+}
+
+// 每个声道的增益，静音/非独奏的声道为0，mono不管声像，left/right用于立体声
+func (m *Mixer) gains() (mono, left, right [ChannelCount]float32) {
+	solo := false
+	for _, ch := range m {
+		solo = solo || ch.Solo
+	}
+	for i, ch := range m {
+		if ch.Muted || (solo && !ch.Solo) {
+			continue
+		}
+		mono[i] = ch.Volume
+		// 平衡式声像: 居中时两边都是原音量，偏向一边时另一边减弱
+		left[i], right[i] = ch.Volume, ch.Volume
+		if ch.Pan > 0 {
+			left[i] *= 1 - ch.Pan
+		} else if ch.Pan < 0 {
+			right[i] *= 1 + ch.Pan
+		}
+	}
+	return
+}
+
+// 按nesdev的非线性公式混音，输入是加权后的声道电平，和pulseTable/tndTable的公式一致
+func mixLevels(levels *[ChannelCount]float32, gains *[ChannelCount]float32) float32 {
+	var out float32
+	pulse := levels[ChannelPulse1]*gains[ChannelPulse1] + levels[ChannelPulse2]*gains[ChannelPulse2]
+	if pulse > 0 {
+		out += 95.52 / (8128.0/pulse + 100)
+	}
+	tnd := 3*levels[ChannelTriangle]*gains[ChannelTriangle] +
+		2*levels[ChannelNoise]*gains[ChannelNoise] +
+		levels[ChannelDMC]*gains[ChannelDMC]
+	if tnd > 0 {
+		out += 163.67 / (24329.0/tnd + 100)
+	}
+	// 扩展音源已经是输出电平，线性叠加
+	out += levels[ChannelExpansion] * gains[ChannelExpansion]
+	return out
+}
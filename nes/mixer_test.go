@@ -0,0 +1,77 @@
+package nes
+
+import (
+	"math"
+	"testing"
+)
+
+// 默认设置下浮点公式要和查表的结果一致
+func TestMixLevelsMatchesTables(t *testing.T) {
+	mixer := DefaultMixer()
+	gains, _, _ := mixer.gains()
+	for p := 0; p <= 30; p += 5 {
+		for tnd := 0; tnd <= 202; tnd += 11 {
+			// DMC的权重是1，电平直接就是tndTable的下标
+			levels := [ChannelCount]float32{ChannelPulse1: float32(p), ChannelDMC: float32(tnd)}
+			got := mixLevels(&levels, &gains)
+			want := pulseTable[p] + tndTable[tnd]
+			if math.Abs(float64(got-want)) > 1e-6 {
+				t.Errorf("pulse %d tnd %d: %v, want %v", p, tnd, got, want)
+			}
+		}
+	}
+}
+
+func TestMixerSoloAndMute(t *testing.T) {
+	mixer := DefaultMixer()
+	mixer[ChannelTriangle].Solo = true
+	mixer[ChannelNoise].Solo = true
+	mixer[ChannelNoise].Muted = true
+	mixer[ChannelTriangle].Pan = -0.5
+	mono, left, right := mixer.gains()
+	want := [ChannelCount]float32{ChannelTriangle: 1}
+	if mono != want {
+		t.Errorf("mono gains %v, want %v", mono, want)
+	}
+	if left[ChannelTriangle] != 1 || right[ChannelTriangle] != 0.5 {
+		t.Errorf("triangle pan gains %v/%v, want 1/0.5", left[ChannelTriangle], right[ChannelTriangle])
+	}
+	if mixer.isDefault() {
+		t.Error("solo mixer reported as default")
+	}
+}
+
+type constantAudio float32
+
+func (a constantAudio) AudioOutput() float32 {
+	return float32(a)
+}
+
+// 扩展音源和APU的声道一样受静音/音量/声像控制
+func TestMixerExpansion(t *testing.T) {
+	console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	console.audio = constantAudio(0.25)
+	apu := console.APU
+	base := tndTable[3*apu.triangle.output()]
+	if got := apu.output() - base; math.Abs(float64(got-0.25)) > 1e-6 {
+		t.Errorf("default expansion %v, want 0.25", got)
+	}
+	mixer := DefaultMixer()
+	mixer[ChannelExpansion].Volume = 0.5
+	mixer[ChannelExpansion].Pan = 1
+	console.SetMixer(mixer)
+	if got := apu.output() - base; math.Abs(float64(got-0.125)) > 1e-6 {
+		t.Errorf("half volume expansion %v, want 0.125", got)
+	}
+	if left, right := apu.stereoOutput(); math.Abs(float64(left-base)) > 1e-6 || math.Abs(float64(right-base-0.125)) > 1e-6 {
+		t.Errorf("panned expansion %v/%v, want 0/0.125 over %v", left, right, base)
+	}
+	mixer[ChannelExpansion].Muted = true
+	console.SetMixer(mixer)
+	if got := apu.output() - base; math.Abs(float64(got)) > 1e-6 {
+		t.Errorf("muted expansion %v, want 0", got)
+	}
+}
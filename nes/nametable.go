@@ -0,0 +1,60 @@
+package nes
+
+/*
+名称表映射:
+$2000-$2FFF分成4个1KB的槽($3000-$3EFF是镜像)，默认按卡带的镜像方式指向主机的2KB显存(CIRAM)，
+四屏卡带的后两个槽指向卡带上的2KB显存。
+
+需要自己决定每个槽指向哪里的mapper(MMC5的ExRAM，Namco 163用CHR ROM当名称表等)实现NameTableMapper，
+可以直接嵌入NameTables，用Map把每个槽指向CIRAM(Console.CIRAM)、卡带显存或者CHR。
+*/
+
+// 可选接口: 自己管理名称表的mapper实现，实现后$2000-$3EFF的访问都交给mapper
+type NameTableMapper interface {
+	ReadNameTable(addr uint16) byte
+	WriteNameTable(addr uint16, value byte)
+}
+
+// 4个1KB槽的名称表映射
+type NameTables struct {
+	slots    [4][]byte
+	writable [4]bool
+}
+
+// 把第slot个槽(0-3)指向data的前1KB，只读时(CHR ROM、MMC5的填充模式等)写入被忽略
+// 槽里保存的是引用，读档后mapper要按寄存器重新Map一遍
+func (n *NameTables) Map(slot int, data []byte, writable bool) {
+	n.slots[slot] = data[:0x400]
+	n.writable[slot] = writable
+}
+
+// 按镜像方式把4个槽指向CIRAM，四屏时后两个槽指向vram
+func (n *NameTables) Mirror(console *Console, mode byte, vram []byte) {
+	for slot, page := range MirrorLookup[mode] {
+		if page < 2 {
+			n.Map(slot, console.CIRAM(int(page)), true)
+		} else {
+			n.Map(slot, vram[(page-2)*0x400:], true)
+		}
+	}
+}
+
+func (n *NameTables) ReadNameTable(addr uint16) byte {
+	slot := (addr >> 10) & 3
+	if n.slots[slot] == nil {
+		return 0
+	}
+	return n.slots[slot][addr&0x3ff]
+}
+
+func (n *NameTables) WriteNameTable(addr uint16, value byte) {
+	slot := (addr >> 10) & 3
+	if n.writable[slot] {
+		n.slots[slot][addr&0x3ff] = value
+	}
+}
+
+// 主机显存的第page页(0或1)，每页1KB
+func (console *Console) CIRAM(page int) []byte {
+	return console.PPU.NameTable[page*0x400 : (page+1)*0x400]
+}
@@ -0,0 +1,61 @@
+package nes
+
+import (
+	"testing"
+)
+
+func TestFourScreen(t *testing.T) {
+	rom := testROM(0, 0, 0x4000, 0x2000, loopProg)
+	rom[6] |= 0x08
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := console.PPU.Memory
+	for i := uint16(0); i < 4; i++ {
+		mem.Write(0x2000+i*0x400, byte(i+1))
+	}
+	for i := uint16(0); i < 4; i++ {
+		if v := mem.Read(0x3000 + i*0x400); v != byte(i+1) {
+			t.Errorf("nametable %d = %d, want %d", i, v, i+1)
+		}
+	}
+	if console.Card.VRAM[0x400] != 4 {
+		t.Error("nametable 3 is not in cartridge VRAM")
+	}
+}
+
+// 第3个槽用CHR当名称表，只读
+type chrNameTableMapper struct {
+	Mapper
+	NameTables
+}
+
+func TestNameTableMapper(t *testing.T) {
+	rom := testROM(15, 0, 0x4000, 0x2000, loopProg)
+	RegisterMapper(MapperInfo{Number: 15, Name: "test", New: func(card *Cartridge, console *Console) (Mapper, error) {
+		m := &chrNameTableMapper{Mapper: NewMapper0(card)}
+		m.Mirror(console, MirrorVertical, nil)
+		m.Map(3, card.CHR[0x400:], false)
+		return m, nil
+	}})
+	defer func() {
+		mappersLock.Lock()
+		delete(mappers, 15)
+		mappersLock.Unlock()
+	}()
+	rom[16+0x4000+0x400] = 0x5A
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mem := console.PPU.Memory
+	mem.Write(0x2000, 1)
+	mem.Write(0x2C00, 2)
+	if v := mem.Read(0x2800); v != 1 {
+		t.Errorf("$2800 = %d, want vertical mirror of $2000", v)
+	}
+	if v := mem.Read(0x2C00); v != 0x5A {
+		t.Errorf("$2C00 = %02X, want CHR byte 5A", v)
+	}
+}
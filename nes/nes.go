@@ -1,42 +1,205 @@
 package nes
 
 import (
-	"strings"
+	"fmt"
+)
+
+const (
+	headerSize     = 16
+	trainerSize    = 512
+	trainerAddress = 0x7000
 )
 
 func LoadNESRom(info []byte) (*Cartridge, error) {
 
+	if len(info) < headerSize {
+		return nil, &TruncatedError{"header", headerSize, len(info)}
+	}
 	tag := info[0:4]
-	if !strings.Contains(string(tag), "NES") {
-		panic("Err: not NES file.")
+	if string(tag) != "NES\x1a" {
+		return nil, ErrBadMagic
 	}
 
-	prgNum := info[4] // PRG块数目 一块大小为 16KB
-	chrNum := info[5] // CHR块数目 一块大小为 8KB
-
 	flag := info[6]
 	flag2 := info[7]
 
-	// trained := int8(flag)&0b100 > 0
-	isNesV2 := int8(flag2)&0b1100 > 0
-	if isNesV2 {
-		panic("Err: not support nes v2.")
+	// flag2 D2D3为2时是NES 2.0格式
+	isNesV2 := flag2&0b1100 == 0b1000
+	// 老的iNES文件byte 7-15常被写入垃圾数据(如"DiskDude!")，
+	// D2D3不为0或者byte 12-15不全为0时，byte 7(mapper高4位和主机类型)不可信
+	if !isNesV2 && (flag2&0b1100 != 0 || !isZero(info[12:16])) {
+		flag2 = 0
 	}
+
+	// 有trainer时头部后面紧跟512字节，PRG要往后挪
+	trained := flag&0b100 > 0
 	mirror := flag & 1
-	mapper := ((flag & 0xf0) >> 4) | (flag2 & 0xf0)
+	// 四屏: 卡带上额外带2KB显存，四个名称表各自独立，忽略镜像位
+	fourScreen := flag&0b1000 > 0
+	if fourScreen {
+		mirror = MirrorFour
+	}
+	mapper := uint16((flag&0xf0)>>4) | uint16(flag2&0xf0)
+
+	// PRG块数目 一块大小为 16KB; CHR块数目 一块大小为 8KB
+	prgSize := int(info[4]) * 16384
+	chrSize := int(info[5]) * 8192
+
+	var header nes2Header
+	if isNesV2 {
+		header = parseNES2Header(info)
+		mapper |= header.mapperHigh
+		prgSize = header.prgSize
+		chrSize = header.chrSize
+	}
+
+	if prgSize < 0 || chrSize < 0 {
+		return nil, &HeaderError{"ROM size exponent out of range"}
+	}
+	if prgSize == 0 {
+		return nil, &HeaderError{"empty PRG-ROM"}
+	}
+	if isNesV2 && flag2&0b11 == 3 && header.extendedConsole > ConsoleFamiclone {
+		return nil, &HeaderError{fmt.Sprintf("extended console type %d", header.extendedConsole)}
+	}
+
+	prgStart := headerSize
+	if trained {
+		prgStart += trainerSize
+		if len(info) < prgStart {
+			return nil, &TruncatedError{"trainer", prgStart, len(info)}
+		}
+	}
+	chrStart := prgStart + prgSize
+	if len(info) < chrStart {
+		return nil, &TruncatedError{"PRG-ROM", chrStart, len(info)}
+	}
+	if len(info) < chrStart+chrSize {
+		return nil, &TruncatedError{"CHR-ROM", chrStart + chrSize, len(info)}
+	}
+
+	prg := make([]byte, prgSize)
+	copy(prg, info[prgStart:chrStart])
 
-	prg := make([]byte, int(prgNum)*16384)
-	copy(prg, info[16:16+int(prgNum)*16384])
+	chr := make([]byte, chrSize)
+	copy(chr, info[chrStart:chrStart+chrSize])
 
-	chr := make([]byte, int(chrNum)*8192)
-	copy(chr, info[16+int(prgNum)*16384:])
+	if chrSize == 0 {
+		// 没有CHR-ROM时使用CHR-RAM，NES 2.0头部给出了具体大小
+		ramSize := header.chrRAMSize + header.chrNVRAMSize
+		if ramSize < 8192 {
+			ramSize = 8192
+		}
+		chr = make([]byte, ramSize)
+	}
+
+	card := NewCartridge(prg, chr, mapper, mirror)
+	card.Battery = flag&0b10 > 0
+	if fourScreen {
+		card.VRAM = make([]byte, 2048)
+	}
+	card.ConsoleType = flag2 & 0b11
+	if isNesV2 {
+		card.NES2 = true
+		card.SubMapper = header.subMapper
+		card.PRGRAMSize = header.prgRAMSize
+		card.PRGNVRAMSize = header.prgNVRAMSize
+		card.CHRRAMSize = header.chrRAMSize
+		card.CHRNVRAMSize = header.chrNVRAMSize
+		if chrSize == 0 && card.CHRRAMSize+card.CHRNVRAMSize == 0 {
+			card.CHRRAMSize = len(chr)
+		}
+		card.Timing = header.timing
+		if card.PRGNVRAMSize > 0 {
+			card.Battery = true
+		}
+		if card.ConsoleType == 3 {
+			card.ConsoleType = header.extendedConsole
+		}
+		// SRAM至少保留$6000-$7FFF的8KB，mapper都是按这个范围直接索引的
+		if sramSize := card.PRGRAMSize + card.PRGNVRAMSize; sramSize > len(card.SRAM) {
+			card.SRAM = make([]byte, sramSize)
+		}
+	} else {
+		card.PRGRAMSize = len(card.SRAM)
+		if chrSize == 0 {
+			card.CHRRAMSize = len(chr)
+		}
+	}
+
+	// 真机上trainer会被放到$7000-$71FF
+	if trained {
+		copy(card.SRAM[trainerAddress-0x6000:], info[headerSize:headerSize+trainerSize])
+	}
+
+	Logger("ROM: PRG-ROM: %d kb, CHR_ROM: %d kb Mapper: %d.%d NES2: %v Timing: %d Battery: %v \n",
+		prgSize/1024, chrSize/1024, card.Mapper, card.SubMapper, card.NES2, card.Timing, card.Battery)
+	return card, nil
+}
+
+// NES 2.0头部byte 8-15携带的扩展信息
+type nes2Header struct {
+	mapperHigh      uint16
+	subMapper       byte
+	prgSize         int
+	chrSize         int
+	prgRAMSize      int
+	prgNVRAMSize    int
+	chrRAMSize      int
+	chrNVRAMSize    int
+	timing          byte
+	extendedConsole byte
+}
+
+func parseNES2Header(info []byte) nes2Header {
+	var h nes2Header
+	// byte 8: 低4位是mapper号的bit 8-11，高4位是submapper
+	h.mapperHigh = uint16(info[8]&0x0f) << 8
+	h.subMapper = info[8] >> 4
+	// byte 9: 低4位是PRG大小的高4位，高4位是CHR大小的高4位
+	h.prgSize = nes2ROMSize(info[4], info[9]&0x0f, 16384)
+	h.chrSize = nes2ROMSize(info[5], info[9]>>4, 8192)
+	// byte 10/11: 低4位易失RAM，高4位带电池RAM，都是移位值
+	h.prgRAMSize = nes2RAMSize(info[10] & 0x0f)
+	h.prgNVRAMSize = nes2RAMSize(info[10] >> 4)
+	h.chrRAMSize = nes2RAMSize(info[11] & 0x0f)
+	h.chrNVRAMSize = nes2RAMSize(info[11] >> 4)
+	// byte 12: CPU/PPU时序
+	h.timing = info[12] & 0b11
+	// byte 13: byte 7主机类型为3时，低4位是扩展主机类型
+	h.extendedConsole = info[13] & 0x0f
+	return h
+}
+
+// ROM大小: 高4位不为0xF时是 (msb<<8|lsb) * 单位大小;
+// 为0xF时lsb是指数-乘数格式 EEEE EEMM，大小为 2^E * (MM*2+1) byte
+func nes2ROMSize(lsb byte, msb byte, unit int) int {
+	if msb != 0x0f {
+		return (int(msb)<<8 | int(lsb)) * unit
+	}
+	exponent := uint(lsb >> 2)
+	if exponent > 30 {
+		return -1
+	}
+	multiplier := int(lsb&0b11)*2 + 1
+	return (1 << exponent) * multiplier
+}
 
-	if chrNum == 0 {
-		chr = make([]byte, 8192)
+// RAM大小: 0表示没有，否则为 64 << shift byte
+func nes2RAMSize(shift byte) int {
+	if shift == 0 {
+		return 0
 	}
+	return 64 << shift
+}
 
-	Logger("ROM: PRG-ROM: %d x 16kb, CHR_ROM: %d x 8kb Mapper: %d \n", prgNum, chrNum, mapper)
-	return NewCartridge(prg, chr, mapper, mirror), nil
+func isZero(data []byte) bool {
+	for _, b := range data {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
 }
 
 /*
@@ -54,9 +217,18 @@ FALG
 FLAG2
 76543210
 ||||||||
-|||||||+- VS Unisystem，不需要了解
-||||||+-- PlayChoice-10，不需要了解
-||||++--- 如果为 2，代表 NES 2.0 格式，不需要了解
+||||||++- 主机类型 0: NES/Famicom 1: Vs. System 2: Playchoice 10 3: 扩展类型(见byte 13)
+||||++--- 如果为 2，代表 NES 2.0 格式
 ++++----- Mapper 号的高 4 bit
 
+NES 2.0 扩展部分
+byte 8:  SSSS MMMM  S: submapper, M: mapper号的bit 8-11
+byte 9:  CCCC PPPP  CHR-ROM/PRG-ROM大小的高4位
+byte 10: pppp PPPP  p: PRG-NVRAM移位值, P: PRG-RAM移位值 (64 << shift byte)
+byte 11: cccc CCCC  c: CHR-NVRAM移位值, C: CHR-RAM移位值
+byte 12: .... ..TT  CPU/PPU时序 0: NTSC 1: PAL 2: 多区域 3: Dendy
+byte 13: Vs. System类型 或 扩展主机类型
+byte 14: 额外ROM数量
+byte 15: 默认输入设备
+
 */
@@ -0,0 +1,267 @@
+package nes
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"reflect"
+	"testing"
+)
+
+// 按头部byte 4-15拼出ROM，PRG/CHR数据长度由调用方给出
+func headerROM(header []byte, dataSize int) []byte {
+	rom := make([]byte, headerSize+dataSize)
+	copy(rom, "NES\x1a")
+	copy(rom[4:headerSize], header)
+	return rom
+}
+
+func TestLoadNESRomHeader(t *testing.T) {
+	cases := []struct {
+		name     string
+		header   []byte // byte 4-15
+		prg, chr int
+		want     Cartridge // 只比较头部相关的字段
+		sram     int
+	}{
+		{
+			name:   "ines",
+			header: []byte{2, 1, 0x43, 0x10},
+			prg:    0x8000,
+			chr:    0x2000,
+			want:   Cartridge{Mapper: 0x14, Mirror: MirrorVertical, Battery: true, PRGRAMSize: 0x2000},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 12-bit mapper and submapper",
+			header: []byte{1, 1, 0x50, 0x28, 0x31},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{Mapper: 0x125, NES2: true, SubMapper: 3},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 size msb",
+			header: []byte{0x02, 0x01, 0x00, 0x08, 0x00, 0x11},
+			prg:    0x102 * 0x4000,
+			chr:    0x101 * 0x2000,
+			want:   Cartridge{NES2: true},
+			sram:   0x2000,
+		},
+		{
+			// PRG: 2^14 * 3，CHR: 2^10 * 5
+			name:   "nes2 exponent-multiplier",
+			header: []byte{14<<2 | 1, 10<<2 | 2, 0x00, 0x08, 0x00, 0xFF},
+			prg:    0xC000,
+			chr:    0x1400,
+			want:   Cartridge{NES2: true},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 ram shifts",
+			header: []byte{1, 0, 0x10, 0x08, 0x00, 0x00, 0x97, 0xA9},
+			prg:    0x4000,
+			want: Cartridge{Mapper: 1, NES2: true, Battery: true,
+				PRGRAMSize: 0x2000, PRGNVRAMSize: 0x8000, CHRRAMSize: 0x8000, CHRNVRAMSize: 0x10000},
+			sram: 0xA000,
+		},
+		{
+			name:   "nes2 default chr ram",
+			header: []byte{1, 0, 0x00, 0x08},
+			prg:    0x4000,
+			want:   Cartridge{NES2: true, CHRRAMSize: 0x2000},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 pal",
+			header: []byte{1, 1, 0x00, 0x08, 0, 0, 0, 0, TimingPAL},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{NES2: true, Timing: TimingPAL},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 dendy",
+			header: []byte{1, 1, 0x00, 0x08, 0, 0, 0, 0, TimingDendy},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{NES2: true, Timing: TimingDendy},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 vs system",
+			header: []byte{1, 1, 0x00, 0x09},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{NES2: true, ConsoleType: ConsoleVsSystem},
+			sram:   0x2000,
+		},
+		{
+			name:   "nes2 extended console",
+			header: []byte{1, 1, 0x00, 0x0B, 0, 0, 0, 0, 0, ConsoleFamiclone},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{NES2: true, ConsoleType: ConsoleFamiclone},
+			sram:   0x2000,
+		},
+		{
+			name:   "four screen",
+			header: []byte{1, 1, 0x09},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{Mirror: MirrorFour, PRGRAMSize: 0x2000},
+			sram:   0x2000,
+		},
+		{
+			// byte 7-15是"DiskDude!"，mapper高4位和主机类型都不可信
+			name:   "diskdude",
+			header: []byte{1, 1, 0x41, 'D', 'i', 's', 'k', 'D', 'u', 'd', 'e', '!'},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{Mapper: 4, Mirror: MirrorVertical, PRGRAMSize: 0x2000},
+			sram:   0x2000,
+		},
+		{
+			// byte 7看起来正常，但byte 12-15有垃圾数据
+			name:   "garbage tail",
+			header: []byte{1, 1, 0x40, 0x10, 0, 0, 0, 0, 'J', 'U', 'N', 'K'},
+			prg:    0x4000,
+			chr:    0x2000,
+			want:   Cartridge{Mapper: 4, PRGRAMSize: 0x2000},
+			sram:   0x2000,
+		},
+	}
+	for _, c := range cases {
+		rom := headerROM(c.header, c.prg+c.chr)
+		rom[headerSize] = 0xAB
+		card, err := LoadNESRom(rom)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		got := Cartridge{
+			Mapper: card.Mapper, Mirror: card.Mirror, Battery: card.Battery,
+			NES2: card.NES2, SubMapper: card.SubMapper,
+			PRGRAMSize: card.PRGRAMSize, PRGNVRAMSize: card.PRGNVRAMSize,
+			CHRRAMSize: card.CHRRAMSize, CHRNVRAMSize: card.CHRNVRAMSize,
+			Timing: card.Timing, ConsoleType: card.ConsoleType,
+		}
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %+v\nwant %+v", c.name, got, c.want)
+		}
+		chr := c.chr
+		if chr == 0 {
+			chr = c.want.CHRRAMSize + c.want.CHRNVRAMSize
+		}
+		if len(card.PRG) != c.prg || len(card.CHR) != chr || len(card.SRAM) != c.sram || card.PRG[0] != 0xAB {
+			t.Errorf("%s: PRG %d CHR %d SRAM %d bytes, want %d %d %d", c.name, len(card.PRG), len(card.CHR), len(card.SRAM), c.prg, chr, c.sram)
+		}
+		if fourScreen := len(card.VRAM) == 2048; fourScreen != (c.want.Mirror == MirrorFour) {
+			t.Errorf("%s: VRAM %d bytes", c.name, len(card.VRAM))
+		}
+	}
+}
+
+// trainer在头部和PRG之间，加载后放在$7000-$71FF
+func TestLoadNESRomTrainer(t *testing.T) {
+	rom := headerROM([]byte{1, 1, 0x04}, trainerSize+0x4000+0x2000)
+	trainer := rom[headerSize : headerSize+trainerSize]
+	for i := range trainer {
+		trainer[i] = byte(i*7 + 1)
+	}
+	rom[headerSize+trainerSize] = 0xAB
+	rom[headerSize+trainerSize+0x4000] = 0xCD
+	card, err := LoadNESRom(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if card.PRG[0] != 0xAB || card.CHR[0] != 0xCD {
+		t.Errorf("PRG[0] = %02X, CHR[0] = %02X, want AB CD", card.PRG[0], card.CHR[0])
+	}
+	if !bytes.Equal(card.SRAM[0x1000:0x1200], trainer) {
+		t.Error("trainer not copied to $7000")
+	}
+	if !isZero(card.SRAM[:0x1000]) || !isZero(card.SRAM[0x1200:]) {
+		t.Error("trainer copied outside $7000-$71FF")
+	}
+
+	// 声明了trainer但文件不够长
+	if _, err := LoadNESRom(rom[:headerSize+trainerSize-1]); err == nil {
+		t.Error("truncated trainer loaded")
+	}
+}
+
+func TestLoadNESRomErrors(t *testing.T) {
+	valid := headerROM([]byte{1, 1}, 0x4000+0x2000)
+
+	if _, err := LoadNESRom(valid[:10]); !errors.Is(err, ErrTruncated) {
+		t.Errorf("short header: err = %v, want ErrTruncated", err)
+	}
+	bad := append([]byte(nil), valid...)
+	bad[3] = 0x1B
+	if _, err := LoadNESRom(bad); !errors.Is(err, ErrBadMagic) {
+		t.Errorf("bad magic: err = %v, want ErrBadMagic", err)
+	}
+
+	for _, c := range []struct {
+		size    int
+		section string
+	}{{0x2000, "PRG-ROM"}, {0x4000 + 0x1000, "CHR-ROM"}} {
+		_, err := LoadNESRom(valid[:headerSize+c.size])
+		var truncated *TruncatedError
+		if !errors.Is(err, ErrTruncated) || !errors.As(err, &truncated) {
+			t.Errorf("truncated %s: err = %v, want TruncatedError", c.section, err)
+			continue
+		}
+		if truncated.Section != c.section || truncated.Got != headerSize+c.size {
+			t.Errorf("truncated %s: %+v", c.section, truncated)
+		}
+	}
+
+	for name, header := range map[string][]byte{
+		"empty prg":        {0, 1},
+		"size exponent":    {0xFC, 1, 0x00, 0x08, 0x00, 0x0F},
+		"extended console": {1, 1, 0x00, 0x0B, 0, 0, 0, 0, 0, 0x0C},
+	} {
+		_, err := LoadNESRom(headerROM(header, 0x4000+0x2000))
+		var headerErr *HeaderError
+		if !errors.Is(err, ErrUnsupportedHeader) || !errors.As(err, &headerErr) {
+			t.Errorf("%s: err = %v, want HeaderError", name, err)
+		}
+	}
+}
+
+// 随机的头部和长度，加载和创建console都只能返回错误，不能panic
+func TestLoadNESRomRandom(t *testing.T) {
+	n := 100000
+	if testing.Short() {
+		n = 10000
+	}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < n; i++ {
+		header := make([]byte, 12)
+		r.Read(header)
+		if r.Intn(2) == 0 {
+			// 一半用小的PRG/CHR，让更多的文件能加载成功
+			header[0] = byte(r.Intn(3))
+			header[1] = byte(r.Intn(2))
+			header[5] &= 0x77
+		}
+		rom := headerROM(header, r.Intn(0xC000))
+		r.Read(rom[headerSize:])
+		if r.Intn(8) == 0 {
+			rom[r.Intn(4)] ^= byte(1 + r.Intn(255))
+		}
+		func() {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("header % X, %d bytes: panic: %v", rom[:headerSize], len(rom), e)
+				}
+			}()
+			if _, err := LoadNESRom(rom); err != nil {
+				return
+			}
+			NewConsole(rom)
+		}()
+	}
+}
@@ -0,0 +1,102 @@
+package nes
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+/*
+nestest.nes 自动模式: 从$C000开始执行，不需要PPU，逐行和参考日志对比
+结束后$02/$03是官方/非官方指令的错误码，0表示全部通过
+*/
+
+const (
+	nestestROM = "testdata/nestest.nes"
+	nestestLog = "testdata/nestest.log"
+)
+
+// 把每行日志收集起来
+type lineTracer struct {
+	console *Console
+	lines   []string
+}
+
+func (t *lineTracer) Trace(cpu *CPU) {
+	ppu := t.console.PPU
+	t.lines = append(t.lines, TraceLine(cpu, ppu.ScanLine, ppu.Cycle))
+}
+
+func readLines(path string) ([]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		line := string(bytes.TrimRight(scanner.Bytes(), "\r "))
+		if line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines, scanner.Err()
+}
+
+func TestNestest(t *testing.T) {
+	rom, err := ioutil.ReadFile(nestestROM)
+	if os.IsNotExist(err) {
+		t.Skipf("%s not found, see testdata/README.md", nestestROM)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := readLines(nestestLog)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 参考日志的起始状态: reset用了7个时钟，PPU走到第0行第21点
+	console.CPU.PC = 0xC000
+	console.CPU.Cycles = 7
+	console.PPU.ScanLine = 0
+	console.PPU.Cycle = 21
+
+	tracer := &lineTracer{console: console}
+	console.CPU.SetTracer(tracer)
+	for len(tracer.lines) < len(want) && !console.CPU.Jammed() {
+		console.Step()
+	}
+	console.CPU.SetTracer(nil)
+
+	for i, line := range tracer.lines {
+		if i >= len(want) {
+			break
+		}
+		if line != want[i] {
+			t.Fatalf("line %d differs\n got: %s\nwant: %s\nprev: %s", i+1, line, want[i], previous(want, i))
+		}
+	}
+	if len(tracer.lines) < len(want) {
+		t.Fatalf("cpu jammed after %d of %d lines", len(tracer.lines), len(want))
+	}
+	if code := console.RAM[2]; code != 0 {
+		t.Errorf("official opcode test failed with code $%02X", code)
+	}
+	if code := console.RAM[3]; code != 0 {
+		t.Errorf("unofficial opcode test failed with code $%02X", code)
+	}
+}
+
+func previous(lines []string, i int) string {
+	if i == 0 {
+		return ""
+	}
+	return lines[i-1]
+}
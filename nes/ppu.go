@@ -22,14 +22,14 @@ type PPU struct {
 	front       *image.RGBA
 	back        *image.RGBA
 
-	// 临时变量
-	register byte
+	// I/O锁存器，CPU读写PPU寄存器时刷新，读只写寄存器时返回它(open bus)
+	// 每一位超过约600ms没有刷新会衰减为0
+	register      byte
+	registerFrame [8]int // 每一位最后刷新时的帧数
 
 	// nmi状态
 	nmiOccurred bool // 触发nmi（要在VBlank时触发NMI)
 	nmiOutput   bool // $2002 D7 VBank标志位，nmi生成标志位，当VBlank时触发，置为true
-	nmiPrevious bool
-	nmiDelay    byte
 
 	// internal寄存器
 	v uint16 // 当前VRAM地址 15bit
@@ -51,6 +51,7 @@ type PPU struct {
 	spritePositions  [8]byte
 	spritePriorities [8]byte
 	spriteIndexes    [8]byte
+	spriteRows       [8]byte // 精灵在这条扫描线上的行，257-320取图案时用
 
 	// 0x2000 PPUCTRL 控制寄存器
 	flagNameTable       byte // 确定当前使用的名称表 0: $2000; 1: $2400; 2: $2800; 3: $2C00
@@ -100,18 +101,12 @@ func (ppu *PPU) tick() {
 		0-239 可见扫描线，进行渲染
 		241-260 触发VBANK 241触发VBANK
 		>260 更新背景和精灵数据，下次渲染预获取等
+		PAL和Dendy每帧312根扫描线，预渲染线是311
 	*/
 
-	//「TODO 看下这里是否正常」 这里是固定间隔就进行一次中断，让CPU有时间更新
-	if ppu.nmiDelay > 0 {
-		ppu.nmiDelay--
-		if ppu.nmiDelay == 0 && ppu.nmiOutput && ppu.nmiOccurred {
-			ppu.console.CPU.TriggerNMI()
-		}
-	}
-
-	if ppu.flagShowBack != 0 || ppu.flagShowSprite != 0 {
-		if ppu.f == 1 && ppu.ScanLine == 261 && ppu.Cycle == 339 {
+	timing := ppu.console.timing
+	if timing.skipOddFrame && (ppu.flagShowBack != 0 || ppu.flagShowSprite != 0) {
+		if ppu.f == 1 && ppu.ScanLine == timing.preLine && ppu.Cycle == 339 {
 			ppu.Cycle = 0
 			ppu.ScanLine = 0
 			ppu.Frame++
@@ -123,7 +118,7 @@ func (ppu *PPU) tick() {
 	if ppu.Cycle > 340 {
 		ppu.Cycle = 0
 		ppu.ScanLine++
-		if ppu.ScanLine > 261 {
+		if ppu.ScanLine > timing.preLine {
 			ppu.ScanLine = 0
 			ppu.Frame++
 			ppu.f ^= 1
@@ -155,7 +150,7 @@ func (ppu *PPU) Step() {
 	renderEnable := ppu.flagShowBack > 0 || ppu.flagShowSprite > 0
 
 	visibleLine := ppu.ScanLine >= 0 && ppu.ScanLine < 240
-	preLine := ppu.ScanLine == 261
+	preLine := ppu.ScanLine == ppu.console.timing.preLine
 	renderLine := visibleLine || preLine
 
 	visibleCycle := ppu.Cycle > 0 && ppu.Cycle <= 256
@@ -208,7 +203,7 @@ func (ppu *PPU) Step() {
 		}
 	}
 
-	if ppu.ScanLine == 241 && ppu.Cycle == 1 {
+	if ppu.ScanLine == ppu.console.timing.vblankLine && ppu.Cycle == 1 {
 		ppu.setVBank()
 	}
 
@@ -221,6 +216,16 @@ func (ppu *PPU) Step() {
 				ppu.spriteCount = 0
 			}
 		}
+		// 257-320每个精灵前两次和337/339真机都会取名称表，数据没用，
+		// MMC5靠总线一直有读取判断在渲染中，靠连续三次相同的读取判断新扫描线开始
+		spriteNameTable := ppu.Cycle >= 257 && ppu.Cycle <= 320 && (ppu.Cycle%8 == 1 || ppu.Cycle%8 == 3)
+		if renderLine && (spriteNameTable || ppu.Cycle == 337 || ppu.Cycle == 339) {
+			ppu.Read(0x2000 | ppu.v&0x0FFF)
+		}
+		// 257-320 每8个点取一个精灵的图案，时机和背景取图案一样，mapper能在总线上看到同样的地址顺序
+		if renderLine && ppu.Cycle >= 257 && ppu.Cycle <= 320 && ppu.Cycle%8 == 5 {
+			ppu.fetchSprite((ppu.Cycle - 257) / 8)
+		}
 	}
 
 	// 超出渲染scan之后，清空中断
@@ -315,7 +320,7 @@ func (ppu *PPU) evaluateSprites() {
 			continue
 		}
 		if count < 8 {
-			ppu.spritePatterns[count] = ppu.fetchSpritePattern(i, row)
+			ppu.spriteRows[count] = byte(row)
 			ppu.spritePositions[count] = x
 			ppu.spritePriorities[count] = (a >> 5) & 1
 			ppu.spriteIndexes[count] = byte(i)
@@ -330,6 +335,21 @@ func (ppu *PPU) evaluateSprites() {
 	ppu.spriteCount = count
 }
 
+// 取第n个精灵的图案，这条线不足8个精灵时真机会用$FF号tile补齐，
+// 取到的数据没用，但地址会出现在总线上，MMC3靠这个在没有精灵时也能数扫描线
+func (ppu *PPU) fetchSprite(n int) {
+	if n < ppu.spriteCount {
+		ppu.spritePatterns[n] = ppu.fetchSpritePattern(int(ppu.spriteIndexes[n]), int(ppu.spriteRows[n]))
+		return
+	}
+	address := uint16(0x1FF0)
+	if ppu.flagSpriteSize == 0 {
+		address = 0x1000*uint16(ppu.flagSpriteTable) + 0xFF*16
+	}
+	ppu.Read(address)
+	ppu.Read(address + 8)
+}
+
 // i表示第几个精灵,row表示这个精灵的y坐标
 func (ppu *PPU) fetchSpritePattern(i, row int) uint32 {
 	// TODO
@@ -530,19 +550,57 @@ func (ppu *PPU) clearVBank() {
 func (ppu *PPU) readRegister(address uint16) byte {
 	switch address {
 	case 0x2002:
-		return ppu.readStatus()
+		value := ppu.readStatus()
+		ppu.refreshBus(value, 0xe0)
+		return value
 	case 0x2004:
-		return ppu.readOAMData()
+		value := ppu.readOAMData()
+		ppu.refreshBus(value, 0xff)
+		return value
 	case 0x2007:
-		return ppu.readData()
+		// 调色板只有6位，高2位是锁存器的值
+		if ppu.v%0x4000 >= 0x3F00 {
+			value := ppu.readData()&0x3f | ppu.openBus()&0xc0
+			ppu.refreshBus(value, 0x3f)
+			return value
+		}
+		value := ppu.readData()
+		ppu.refreshBus(value, 0xff)
+		return value
+	}
+	// 只写寄存器
+	return ppu.openBus()
+}
+
+// 大约600ms
+const ppuBusDecayFrames = 36
+
+// 读取I/O锁存器，太久没有刷新的位衰减为0
+func (ppu *PPU) openBus() byte {
+	for i := uint(0); i < 8; i++ {
+		if ppu.Frame-ppu.registerFrame[i] > ppuBusDecayFrames {
+			ppu.register &^= 1 << i
+		}
+	}
+	return ppu.register
+}
+
+// 用value里mask对应的位刷新I/O锁存器
+func (ppu *PPU) refreshBus(value byte, mask byte) {
+	ppu.register = ppu.register&^mask | value&mask
+	for i := uint(0); i < 8; i++ {
+		if mask&(1<<i) != 0 {
+			ppu.registerFrame[i] = ppu.Frame
+		}
 	}
-	return 0
 }
 
 // https://wiki.nesdev.org/w/index.php?title=PPU_registers
 // cpu修改ppu寄存器，其中几个寄存器从0x2000-0x2007
 func (ppu *PPU) writeRegister(addr uint16, value byte) {
-	ppu.register = value
+	if addr < 0x4000 {
+		ppu.refreshBus(value, 0xff)
+	}
 	switch addr {
 	// PPUCTRL
 	case 0x2000:
@@ -567,14 +625,9 @@ func (ppu *PPU) writeRegister(addr uint16, value byte) {
 }
 
 // 0x4014
+// 由CPU逐个时钟完成复制，见CPU.stepDMA
 func (ppu *PPU) writeDMA(value byte) {
-	cpu := ppu.console.CPU
-	address := uint16(value) << 8
-	for i := 0; i < 256; i++ {
-		ppu.oamData[ppu.oamAddress] = cpu.Read(address)
-		ppu.oamAddress++
-		address++
-	}
+	ppu.console.CPU.startOAMDMA(value)
 }
 
 func (ppu *PPU) readOAMData() byte {
@@ -628,6 +681,8 @@ func (ppu *PPU) writeAddress(value byte) {
 		ppu.t = (ppu.t & uint16(0xff00)) | uint16(value)
 		ppu.v = ppu.t
 		ppu.w = 0
+		// 新地址直接出现在总线上，有的游戏靠这个给MMC3的计数器打时钟
+		ppu.console.ppuAddress(ppu.v % 0x4000)
 	}
 }
 
@@ -663,7 +718,7 @@ func (ppu *PPU) writeData(value byte) {
 
 // $2002: PPUSTATUS
 func (ppu *PPU) readStatus() byte {
-	result := ppu.register & 0x1f
+	result := ppu.openBus() & 0x1f
 	result |= ppu.flagSpriteOverflow << 5
 	result |= ppu.flagSpriteZeroHit << 6
 	if ppu.nmiOccurred {
@@ -720,12 +775,67 @@ func (ppu *PPU) WritePalette(addr uint16, value byte) {
 	ppu.paletteData[addr] = value
 }
 
+// NMI输出电平，CPU在由低变高时触发NMI
 func (ppu *PPU) nmiChange() {
-	nmi := ppu.nmiOutput && ppu.nmiOccurred
-	if nmi && !ppu.nmiPrevious {
-		ppu.nmiDelay = 15
+	ppu.console.CPU.SetNMI(ppu.nmiOutput && ppu.nmiOccurred)
+}
+
+func (ppu *PPU) serialize(s *Serializer) {
+	s.Int(&ppu.Cycle)
+	s.Int(&ppu.ScanLine)
+	s.Int(&ppu.Frame)
+
+	s.Bytes(ppu.paletteData[:])
+	s.Bytes(ppu.NameTable[:])
+	s.Bytes(ppu.oamData[:])
+
+	s.Byte(&ppu.register)
+	for i := range ppu.registerFrame {
+		s.Int(&ppu.registerFrame[i])
 	}
-	ppu.nmiPrevious = nmi
+
+	s.Bool(&ppu.nmiOccurred)
+	s.Bool(&ppu.nmiOutput)
+
+	s.Uint16(&ppu.v)
+	s.Uint16(&ppu.t)
+	s.Byte(&ppu.x)
+	s.Byte(&ppu.w)
+	s.Byte(&ppu.f)
+
+	s.Byte(&ppu.nameTableByte)
+	s.Byte(&ppu.attributeTableByte)
+	s.Byte(&ppu.lowTileByte)
+	s.Byte(&ppu.highTileByte)
+	s.Uint64(&ppu.tileData)
+
+	s.Int(&ppu.spriteCount)
+	for i := 0; i < 8; i++ {
+		s.Uint32(&ppu.spritePatterns[i])
+		s.Byte(&ppu.spritePositions[i])
+		s.Byte(&ppu.spritePriorities[i])
+		s.Byte(&ppu.spriteIndexes[i])
+		s.Byte(&ppu.spriteRows[i])
+	}
+
+	s.Byte(&ppu.flagNameTable)
+	s.Byte(&ppu.flagIncrement)
+	s.Byte(&ppu.flagSpriteTable)
+	s.Byte(&ppu.flagBackgroundTable)
+	s.Byte(&ppu.flagSpriteSize)
+	s.Byte(&ppu.flagMasterSlave)
+
+	s.Byte(&ppu.flagDisplayMode)
+	s.Byte(&ppu.flagShowLeftBack)
+	s.Byte(&ppu.flagShowLeftSprite)
+	s.Byte(&ppu.flagShowBack)
+	s.Byte(&ppu.flagShowSprite)
+
+	s.Byte(&ppu.flagSpriteOverflow)
+	s.Byte(&ppu.flagSpriteZeroHit)
+
+	s.Byte(&ppu.oamAddress)
+	s.Byte(&ppu.bufferedData)
 }
 
 /*
@@ -0,0 +1,127 @@
+package nes
+
+import (
+	"fmt"
+	"hash/crc32"
+	"strings"
+)
+
+/*
+主机区域，决定CPU/PPU/APU的时序:
+
+        CPU时钟     PPU/CPU  扫描线  VBANK开始  帧计数器
+NTSC    1789773Hz   3        262     241        240Hz
+PAL     1662607Hz   3.2      312     241        200Hz
+Dendy   1773448Hz   3        312     291        同NTSC
+
+PAL的APU噪声和DMC周期表与NTSC不同，Dendy沿用NTSC的表
+NTSC在开启渲染时奇数帧少一个PPU时钟，PAL和Dendy没有
+*/
+
+type Region byte
+
+const (
+	RegionNTSC Region = iota
+	RegionPAL
+	RegionDendy
+)
+
+const (
+	PALCPUFrequency   = 1662607
+	DendyCPUFrequency = 1773448
+)
+
+var regionNames = [...]string{"ntsc", "pal", "dendy"}
+
+func (r Region) String() string {
+	if int(r) < len(regionNames) {
+		return regionNames[r]
+	}
+	return fmt.Sprintf("Region(%d)", r)
+}
+
+// 按名字(ntsc/pal/dendy，不区分大小写)查找区域
+func ParseRegion(name string) (Region, error) {
+	for i, n := range regionNames {
+		if strings.EqualFold(name, n) {
+			return Region(i), nil
+		}
+	}
+	return 0, fmt.Errorf("nes: unknown region %q", name)
+}
+
+var palNoiseTable = []uint16{
+	4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778,
+}
+
+var palDMCTable = []byte{
+	199, 177, 158, 149, 138, 118, 105, 99, 88, 74, 66, 59, 49, 39, 33, 25,
+}
+
+type regionTiming struct {
+	cpuFrequency float64
+	ppuRatio     int64 // PPU时钟/CPU时钟的5倍，PAL不是整数倍
+	preLine      int   // 预渲染扫描线，也是每帧最后一根
+	vblankLine   int
+	skipOddFrame bool
+	framePeriod  float64 // 帧计数器每步的CPU时钟数
+	noiseTable   []uint16
+	dmcTable     []byte
+}
+
+var regionTimings = [...]regionTiming{
+	RegionNTSC: {
+		cpuFrequency: CPUFrequency, ppuRatio: 15, preLine: 261, vblankLine: 241, skipOddFrame: true,
+		framePeriod: CPUFrequency / FrameCounterRate, noiseTable: noiseTable, dmcTable: dmcTable,
+	},
+	RegionPAL: {
+		cpuFrequency: PALCPUFrequency, ppuRatio: 16, preLine: 311, vblankLine: 241,
+		framePeriod: 8313, noiseTable: palNoiseTable, dmcTable: palDMCTable,
+	},
+	RegionDendy: {
+		cpuFrequency: DendyCPUFrequency, ppuRatio: 15, preLine: 311, vblankLine: 291,
+		framePeriod: CPUFrequency / FrameCounterRate, noiseTable: noiseTable, dmcTable: dmcTable,
+	},
+}
+
+func (r Region) timing() *regionTiming {
+	if int(r) >= len(regionTimings) {
+		r = RegionNTSC
+	}
+	return &regionTimings[r]
+}
+
+// 每秒帧数，NTSC约60.0988，PAL和Dendy约50.007
+func (r Region) FrameRate() float64 {
+	t := r.timing()
+	dots := float64((t.preLine + 1) * 341)
+	if t.skipOddFrame {
+		dots -= 0.5
+	}
+	return t.cpuFrequency * float64(t.ppuRatio) / 5 / dots
+}
+
+// 头部没有时序信息的老ROM按PRG的CRC32查区域，前端可以从外部数据库导入
+var romRegions = map[uint32]Region{}
+
+func RegisterROMRegion(prgCRC uint32, region Region) {
+	romRegions[prgCRC] = region
+}
+
+// 自动识别区域: 优先用NES 2.0头部，其次查ROM数据库，都没有时按NTSC
+func DetectRegion(card *Cartridge) Region {
+	if card.NES2 {
+		switch card.Timing {
+		case TimingNTSC:
+			return RegionNTSC
+		case TimingPAL:
+			return RegionPAL
+		case TimingDendy:
+			return RegionDendy
+		}
+	}
+	if region, ok := romRegions[crc32.ChecksumIEEE(card.PRG)]; ok {
+		return region
+	}
+	return RegionNTSC
+}
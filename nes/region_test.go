@@ -0,0 +1,60 @@
+package nes
+
+import (
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+// 打开渲染时每帧的CPU时钟数，NTSC奇数帧少一个PPU时钟
+func TestRegionFrameCycles(t *testing.T) {
+	for _, c := range []struct {
+		region Region
+		cycles float64
+	}{
+		{RegionNTSC, 29780.5},
+		{RegionPAL, 33247.5},
+		{RegionDendy, 35464},
+	} {
+		console, err := NewConsole(testROM(0, 0, 0x4000, 0x2000, loopProg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		console.SetRegion(c.region)
+		console.runFrame()
+		console.runFrame()
+		const frames = 40
+		start := console.CPU.Cycles
+		for i := 0; i < frames; i++ {
+			console.runFrame()
+		}
+		// 帧在指令中间开始，两端各有几个时钟的误差
+		if got := float64(console.CPU.Cycles-start) / frames; math.Abs(got-c.cycles) > 0.2 {
+			t.Errorf("%v: %.2f cpu cycles per frame, want %v", c.region, got, c.cycles)
+		}
+	}
+}
+
+func TestDetectRegion(t *testing.T) {
+	card := NewCartridge(make([]byte, 0x4000), make([]byte, 0x2000), 0, 0)
+	card.NES2 = true
+	for timing, want := range []Region{RegionNTSC, RegionPAL, RegionNTSC, RegionDendy} {
+		card.Timing = byte(timing)
+		if got := DetectRegion(card); got != want {
+			t.Errorf("timing %d: %v, want %v", timing, got, want)
+		}
+	}
+
+	// iNES头部没有时序，按PRG的CRC查
+	card.NES2 = false
+	card.Timing = TimingNTSC
+	if got := DetectRegion(card); got != RegionNTSC {
+		t.Errorf("unknown ines rom: %v, want ntsc", got)
+	}
+	sum := crc32.ChecksumIEEE(card.PRG)
+	RegisterROMRegion(sum, RegionPAL)
+	defer delete(romRegions, sum)
+	if got := DetectRegion(card); got != RegionPAL {
+		t.Errorf("registered ines rom: %v, want pal", got)
+	}
+}
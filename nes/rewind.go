@@ -0,0 +1,213 @@
+package nes
+
+import (
+	"encoding/binary"
+)
+
+/*
+回放(倒带)缓冲区
+
+每隔interval帧保存一次即时存档，只保留最新一份完整快照，
+更早的快照都存成和后一份快照的差值(异或后对0做行程编码)，
+相邻帧之间大部分内存不变，差值通常只有几百字节。
+
+倒带时从最新的快照开始往回解码，最老的快照可以直接丢弃，
+所以超出内存预算时从最老的一端删除。
+*/
+
+// 默认每2帧存一次，32MB内存预算
+const (
+	DefaultRewindInterval = 2
+	DefaultRewindBudget   = 32 << 20
+)
+
+type Rewind struct {
+	console  *Console
+	interval int // 每隔多少帧保存一次
+	budget   int // 内存预算(byte)
+
+	latest []byte // 最新一份完整快照
+	frame  int    // 最新快照对应的PPU帧数
+
+	// 环形队列，保存latest之前的快照，每份都是相对于后一份的差值
+	entries []rewindEntry
+	start   int
+	count   int
+	used    int // 所有差值加latest占用的内存
+}
+
+type rewindEntry struct {
+	delta []byte
+	frame int
+}
+
+func NewRewind(console *Console, interval int, budget int) *Rewind {
+	if interval < 1 {
+		interval = 1
+	}
+	return &Rewind{console: console, interval: interval, budget: budget}
+}
+
+// 每帧开始时调用，到了间隔就保存一份快照
+func (r *Rewind) Capture() {
+	frame := r.console.PPU.Frame
+	if frame%r.interval != 0 || (r.latest != nil && frame == r.frame) {
+		return
+	}
+	state, err := r.console.saveState()
+	if err != nil {
+		return
+	}
+	if r.latest != nil {
+		r.push(rewindEntry{encodeDelta(state, r.latest), r.frame})
+		r.used -= len(r.latest)
+	}
+	r.latest = state
+	r.frame = frame
+	r.used += len(state)
+	for r.used > r.budget && r.count > 0 {
+		r.dropOldest()
+	}
+}
+
+// 往回倒带至少frames帧(按保存间隔取整)，返回实际倒退的帧数，没有可用快照时返回0
+func (r *Rewind) Rewind(frames int) int {
+	if r.latest == nil || frames <= 0 {
+		return 0
+	}
+	current := r.console.PPU.Frame
+	target := current - frames
+	state := r.latest
+	frame := r.frame
+	for frame > target && r.count > 0 {
+		entry := r.popNewest()
+		r.used -= len(entry.delta)
+		state = decodeDelta(state, entry.delta)
+		frame = entry.frame
+	}
+	if frame >= current {
+		return 0
+	}
+	if err := r.console.loadState(state); err != nil {
+		return 0
+	}
+	r.used += len(state) - len(r.latest)
+	r.latest = state
+	r.frame = frame
+	return current - frame
+}
+
+// 可以倒退的帧数
+func (r *Rewind) Frames() int {
+	if r.latest == nil {
+		return 0
+	}
+	if r.count == 0 {
+		return r.console.PPU.Frame - r.frame
+	}
+	oldest := r.entries[r.start]
+	return r.console.PPU.Frame - oldest.frame
+}
+
+// 清空缓冲区，读档/重置后之前的快照就没有意义了
+func (r *Rewind) Reset() {
+	r.latest = nil
+	r.entries = nil
+	r.start = 0
+	r.count = 0
+	r.used = 0
+}
+
+func (r *Rewind) push(entry rewindEntry) {
+	if r.count == len(r.entries) {
+		// 队列满了扩容一倍，按顺序搬到新数组开头
+		size := len(r.entries) * 2
+		if size == 0 {
+			size = 64
+		}
+		entries := make([]rewindEntry, size)
+		for i := 0; i < r.count; i++ {
+			entries[i] = r.entries[(r.start+i)%len(r.entries)]
+		}
+		r.entries = entries
+		r.start = 0
+	}
+	r.entries[(r.start+r.count)%len(r.entries)] = entry
+	r.count++
+	r.used += len(entry.delta)
+}
+
+func (r *Rewind) popNewest() rewindEntry {
+	index := (r.start + r.count - 1) % len(r.entries)
+	entry := r.entries[index]
+	r.entries[index] = rewindEntry{}
+	r.count--
+	return entry
+}
+
+func (r *Rewind) dropOldest() {
+	entry := r.entries[r.start]
+	r.entries[r.start] = rewindEntry{}
+	r.start = (r.start + 1) % len(r.entries)
+	r.count--
+	r.used -= len(entry.delta)
+}
+
+/*
+encodeDelta得到的差值配合base可以还原出target
+差值格式: 重复若干组 [相同字节数 uvarint][不同字节数 uvarint][异或后的不同字节]
+两份快照长度不同时(理论上不会)，第一个uvarint为0xFFFFFFFF，后面直接跟完整快照
+*/
+const rewindFullSnapshot = 0xFFFFFFFF
+
+func encodeDelta(base []byte, target []byte) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	if len(base) != len(target) {
+		n := binary.PutUvarint(tmp[:], rewindFullSnapshot)
+		out := append([]byte{}, tmp[:n]...)
+		return append(out, target...)
+	}
+	var out []byte
+	i := 0
+	for i < len(target) {
+		same := i
+		for same < len(target) && base[same] == target[same] {
+			same++
+		}
+		diff := same
+		for diff < len(target) && base[diff] != target[diff] {
+			diff++
+		}
+		n := binary.PutUvarint(tmp[:], uint64(same-i))
+		out = append(out, tmp[:n]...)
+		n = binary.PutUvarint(tmp[:], uint64(diff-same))
+		out = append(out, tmp[:n]...)
+		for j := same; j < diff; j++ {
+			out = append(out, base[j]^target[j])
+		}
+		i = diff
+	}
+	return out
+}
+
+func decodeDelta(base []byte, delta []byte) []byte {
+	if skip, n := binary.Uvarint(delta); skip == rewindFullSnapshot {
+		return append([]byte{}, delta[n:]...)
+	}
+	out := make([]byte, len(base))
+	copy(out, base)
+	i := 0
+	for len(delta) > 0 {
+		same, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		diff, n := binary.Uvarint(delta)
+		delta = delta[n:]
+		i += int(same)
+		for j := 0; j < int(diff); j++ {
+			out[i] ^= delta[j]
+			i++
+		}
+		delta = delta[diff:]
+	}
+	return out
+}
@@ -0,0 +1,356 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math"
+)
+
+/*
+即时存档格式，所有数字都是小端序
+
+"FCST"             4byte 魔数
+version            uint16 格式版本，字段有增减时+1
+sections...        若干段，每段: 4byte 标签 + uint32 长度 + 内容
+
+每个部件(CPU/PPU/APU/mapper/手柄/卡带)各占一段，读档时按标签查找，
+未知的段直接跳过，缺少的段或长度不符则报错。
+*/
+
+const stateMagic = "FCST"
+
+// 当前存档格式版本
+const stateVersion = 9
+
+// 各段的标签
+const (
+	sectionConsole = "CONS"
+	sectionCPU     = "CPU "
+	sectionPPU     = "PPU "
+	sectionAPU     = "APU "
+	sectionMapper  = "MAPR"
+	sectionCard    = "CART"
+	sectionCtrl1   = "CTL1"
+	sectionCtrl2   = "CTL2"
+)
+
+// 需要参与存档的部件，save和load共用一个方法，由Serializer决定方向
+type stateful interface {
+	serialize(s *Serializer)
+}
+
+// 带状态的mapper要实现这个接口才能存档，外部注册的mapper也可以实现
+type StatefulMapper interface {
+	Serialize(s *Serializer)
+}
+
+// Serializer 按固定顺序读写状态字段，存档和读档共用同一段代码，保证字段顺序一致
+type Serializer struct {
+	loading bool
+	data    []byte
+	pos     int
+	err     error
+}
+
+func newStateWriter() *Serializer {
+	return &Serializer{}
+}
+
+func newStateReader(data []byte) *Serializer {
+	return &Serializer{loading: true, data: data}
+}
+
+// 是否处于读档方向
+func (s *Serializer) Loading() bool {
+	return s.loading
+}
+
+func (s *Serializer) Err() error {
+	return s.err
+}
+
+// 读档时取出接下来的n个字节，长度不够记录错误
+func (s *Serializer) next(n int) []byte {
+	if s.err != nil {
+		return nil
+	}
+	if s.pos+n > len(s.data) {
+		s.err = ErrBadState
+		return nil
+	}
+	b := s.data[s.pos : s.pos+n]
+	s.pos += n
+	return b
+}
+
+func (s *Serializer) Byte(v *byte) {
+	if !s.loading {
+		s.data = append(s.data, *v)
+		return
+	}
+	if b := s.next(1); b != nil {
+		*v = b[0]
+	}
+}
+
+func (s *Serializer) Bool(v *bool) {
+	var b byte
+	if *v {
+		b = 1
+	}
+	s.Byte(&b)
+	*v = b != 0
+}
+
+func (s *Serializer) Uint16(v *uint16) {
+	if !s.loading {
+		s.data = append(s.data, byte(*v), byte(*v>>8))
+		return
+	}
+	if b := s.next(2); b != nil {
+		*v = binary.LittleEndian.Uint16(b)
+	}
+}
+
+func (s *Serializer) Uint32(v *uint32) {
+	if !s.loading {
+		var b [4]byte
+		binary.LittleEndian.PutUint32(b[:], *v)
+		s.data = append(s.data, b[:]...)
+		return
+	}
+	if b := s.next(4); b != nil {
+		*v = binary.LittleEndian.Uint32(b)
+	}
+}
+
+func (s *Serializer) Uint64(v *uint64) {
+	if !s.loading {
+		var b [8]byte
+		binary.LittleEndian.PutUint64(b[:], *v)
+		s.data = append(s.data, b[:]...)
+		return
+	}
+	if b := s.next(8); b != nil {
+		*v = binary.LittleEndian.Uint64(b)
+	}
+}
+
+// int统一按64位保存
+func (s *Serializer) Int(v *int) {
+	u := uint64(int64(*v))
+	s.Uint64(&u)
+	*v = int(int64(u))
+}
+
+func (s *Serializer) Float64(v *float64) {
+	u := math.Float64bits(*v)
+	s.Uint64(&u)
+	*v = math.Float64frombits(u)
+}
+
+// 定长内存块，先写长度，读档时长度必须一致
+func (s *Serializer) Bytes(b []byte) {
+	n := uint32(len(b))
+	s.Uint32(&n)
+	if !s.loading {
+		s.data = append(s.data, b...)
+		return
+	}
+	if s.err == nil && int(n) != len(b) {
+		s.err = fmt.Errorf("%w: memory block is %d bytes, expected %d", ErrBadState, n, len(b))
+		return
+	}
+	if src := s.next(len(b)); src != nil {
+		copy(b, src)
+	}
+}
+
+// 存档写出到w
+func (console *Console) SaveState(w io.Writer) error {
+	data, err := console.saveState()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
+
+// 从r读档，出错时console保持读档前的状态
+func (console *Console) LoadState(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if err := console.loadState(data); err != nil {
+		return err
+	}
+	// 读档后之前的倒带快照不再连续
+	if console.rewind != nil {
+		console.rewind.Reset()
+	}
+	return nil
+}
+
+func (console *Console) stateSections() ([]string, map[string]stateful, error) {
+	mapper, ok := console.Mapper.(StatefulMapper)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: mapper %d does not support save states", ErrBadState, console.Card.Mapper)
+	}
+	order := []string{
+		sectionConsole, sectionCPU, sectionPPU, sectionAPU,
+		sectionCard, sectionMapper, sectionCtrl1, sectionCtrl2,
+	}
+	parts := map[string]stateful{
+		sectionConsole: (*consoleState)(console),
+		sectionCPU:     console.CPU,
+		sectionPPU:     console.PPU,
+		sectionAPU:     console.APU,
+		sectionCard:    console.Card,
+		sectionMapper:  mapperState{mapper},
+		sectionCtrl1:   console.Controller1,
+		sectionCtrl2:   console.Controller2,
+	}
+	return order, parts, nil
+}
+
+func (console *Console) saveState() ([]byte, error) {
+	order, parts, err := console.stateSections()
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(stateMagic)
+	binary.Write(&buf, binary.LittleEndian, uint16(stateVersion))
+	for _, tag := range order {
+		s := newStateWriter()
+		parts[tag].serialize(s)
+		buf.WriteString(tag)
+		binary.Write(&buf, binary.LittleEndian, uint32(len(s.data)))
+		buf.Write(s.data)
+	}
+	return buf.Bytes(), nil
+}
+
+func (console *Console) loadState(data []byte) error {
+	sections, err := parseStateSections(data)
+	if err != nil {
+		return err
+	}
+	order, parts, err := console.stateSections()
+	if err != nil {
+		return err
+	}
+	for _, tag := range order {
+		if _, ok := sections[tag]; !ok {
+			return fmt.Errorf("%w: missing section %q", ErrBadState, tag)
+		}
+	}
+	// 先检查是不是同一个游戏的存档
+	if err := console.checkStateROM(sections[sectionConsole]); err != nil {
+		return err
+	}
+
+	// 读到一半出错时恢复原来的状态
+	backup, err := console.saveState()
+	if err != nil {
+		return err
+	}
+	for _, tag := range order {
+		s := newStateReader(sections[tag])
+		parts[tag].serialize(s)
+		if s.err == nil && s.pos != len(s.data) {
+			s.err = fmt.Errorf("%w: section %q has %d trailing bytes", ErrBadState, tag, len(s.data)-s.pos)
+		}
+		if s.err != nil {
+			console.restoreState(backup)
+			return s.err
+		}
+	}
+	return nil
+}
+
+// 用saveState的结果恢复，数据是自己生成的，不会出错
+func (console *Console) restoreState(data []byte) {
+	sections, _ := parseStateSections(data)
+	order, parts, _ := console.stateSections()
+	for _, tag := range order {
+		parts[tag].serialize(newStateReader(sections[tag]))
+	}
+}
+
+func parseStateSections(data []byte) (map[string][]byte, error) {
+	if len(data) < 6 || string(data[:4]) != stateMagic {
+		return nil, ErrBadState
+	}
+	version := binary.LittleEndian.Uint16(data[4:6])
+	if version != stateVersion {
+		return nil, &StateVersionError{version, stateVersion}
+	}
+	sections := map[string][]byte{}
+	data = data[6:]
+	for len(data) > 0 {
+		if len(data) < 8 {
+			return nil, ErrBadState
+		}
+		tag := string(data[:4])
+		size := binary.LittleEndian.Uint32(data[4:8])
+		data = data[8:]
+		if uint64(size) > uint64(len(data)) {
+			return nil, ErrBadState
+		}
+		sections[tag] = data[:size]
+		data = data[size:]
+	}
+	return sections, nil
+}
+
+// console段: 记录ROM的校验值和内部RAM
+type consoleState Console
+
+func (c *consoleState) romChecksum() uint32 {
+	return crc32.ChecksumIEEE(c.Card.PRG)
+}
+
+func (c *consoleState) serialize(s *Serializer) {
+	sum := c.romChecksum()
+	s.Uint32(&sum)
+	s.Bytes(c.RAM)
+	if mem, ok := c.CPU.Memory.(*CPUMemory); ok {
+		s.Byte(&mem.bus)
+	}
+	// 区域跟着存档走，读档时按存档里的区域切换时序
+	region := byte(c.region)
+	s.Byte(&region)
+	if s.loading && s.err == nil && Region(region) != c.region {
+		(*Console)(c).SetRegion(Region(region))
+	}
+	remainder := int(c.ppuRemainder)
+	s.Int(&remainder)
+	c.ppuRemainder = int64(remainder)
+}
+
+func (console *Console) checkStateROM(section []byte) error {
+	s := newStateReader(section)
+	var sum uint32
+	s.Uint32(&sum)
+	if s.err != nil {
+		return s.err
+	}
+	if sum != (*consoleState)(console).romChecksum() {
+		return ErrStateMismatch
+	}
+	return nil
+}
+
+type mapperState struct {
+	mapper StatefulMapper
+}
+
+func (m mapperState) serialize(s *Serializer) {
+	m.mapper.Serialize(s)
+}
@@ -0,0 +1,118 @@
+package nes
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"testing"
+)
+
+// 读档到新的console，两边继续运行同样的帧数，状态和画面都要一样
+func TestStateRoundTrip(t *testing.T) {
+	inputs := []FrameInput{{}, {Player1: [8]bool{ButtonA: true}}, {Player1: [8]bool{ButtonStart: true}}}
+	for _, mapper := range []uint16{0, 1, 4, 5, 21} {
+		rom := testROM(mapper, 0, 0x20000, 0x2000, loopProg)
+		console, err := NewConsole(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := console.RunFrames(20, inputs); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		if err := console.SaveState(&buf); err != nil {
+			t.Fatalf("mapper %d: %v", mapper, err)
+		}
+		loaded, err := NewConsole(rom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := loaded.LoadState(&buf); err != nil {
+			t.Fatalf("mapper %d: %v", mapper, err)
+		}
+		for _, c := range []*Console{console, loaded} {
+			if err := c.RunFrames(30, inputs); err != nil {
+				t.Fatal(err)
+			}
+		}
+		a, _ := console.saveState()
+		b, _ := loaded.saveState()
+		if !bytes.Equal(a, b) {
+			t.Errorf("mapper %d: state differs after loading", mapper)
+		}
+		if !bytes.Equal(console.Buffer().Pix, loaded.Buffer().Pix) {
+			t.Errorf("mapper %d: frame differs after loading", mapper)
+		}
+	}
+}
+
+// 替换存档中tag段的内容
+func replaceSection(data []byte, tag string, f func([]byte) []byte) []byte {
+	out := append([]byte(nil), data[:6]...)
+	for data = data[6:]; len(data) > 0; {
+		size := binary.LittleEndian.Uint32(data[4:8])
+		body := data[8 : 8+size]
+		if string(data[:4]) == tag {
+			body = f(append([]byte(nil), body...))
+		}
+		var size4 [4]byte
+		binary.LittleEndian.PutUint32(size4[:], uint32(len(body)))
+		out = append(out, data[:4]...)
+		out = append(out, size4[:]...)
+		out = append(out, body...)
+		data = data[8+size:]
+	}
+	return out
+}
+
+// 读档失败时返回对应的错误，console保持原样
+func TestStateLoadErrors(t *testing.T) {
+	rom := testROM(4, 0, 0x20000, 0x2000, loopProg)
+	console, err := NewConsole(rom)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := console.RunFrames(10, nil); err != nil {
+		t.Fatal(err)
+	}
+	state, _ := console.saveState()
+
+	other := append([]byte(nil), rom...)
+	other[16] ^= 0xFF
+	otherConsole, err := NewConsole(other)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherState, _ := otherConsole.saveState()
+
+	wrongVersion := append([]byte(nil), state...)
+	binary.LittleEndian.PutUint16(wrongVersion[4:], stateVersion-1)
+	truncated := replaceSection(state, sectionPPU, func(b []byte) []byte { return b[:len(b)-1] })
+
+	if err := console.RunFrames(5, nil); err != nil {
+		t.Fatal(err)
+	}
+	before, _ := console.saveState()
+	for _, c := range []struct {
+		name string
+		data []byte
+		want error
+	}{
+		{"version", wrongVersion, ErrBadState},
+		{"other rom", otherState, ErrStateMismatch},
+		{"truncated", truncated, ErrBadState},
+		{"magic", []byte("FCSX\x09\x00"), ErrBadState},
+	} {
+		err := console.LoadState(bytes.NewReader(c.data))
+		if !errors.Is(err, c.want) {
+			t.Errorf("%s: err = %v, want %v", c.name, err, c.want)
+		}
+		if after, _ := console.saveState(); !bytes.Equal(before, after) {
+			t.Errorf("%s: console changed by failed load", c.name)
+		}
+	}
+	var version *StateVersionError
+	if err := console.LoadState(bytes.NewReader(wrongVersion)); !errors.As(err, &version) || version.Version != stateVersion-1 || version.Want != stateVersion {
+		t.Errorf("err = %v, want StateVersionError", err)
+	}
+}
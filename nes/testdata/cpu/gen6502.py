@@ -0,0 +1,410 @@
+#!/usr/bin/env python3
+"""
+生成 testdata/cpu/xx.json: 每个opcode若干条单条指令用例，格式和SingleStepTests/ProcessorTests的nes6502一样
+
+这是一个独立于模拟器代码的参考模型:
+- 指令表按标准的NMOS 6502 opcode矩阵重新写，没有用cpu.go里的表
+- 每个时钟的总线访问按 6502.org 的 64doc ("6502 Microprocessor Instruction Set" 附录的逐周期表) 写
+- 非官方指令按 nesdev wiki "CPU unofficial opcodes"，不稳定的 XAA/LAX# 用常数 $EE
+
+用法: python3 gen6502.py [每个opcode的用例数，默认8]，在本目录运行
+"""
+
+import json
+import random
+import sys
+
+# 寻址方式
+IMP, ACC, IMM, ZP, ZPX, ZPY, ABS, ABX, ABY, IZX, IZY, IND, REL = range(13)
+
+# 标准opcode矩阵，每行16个
+MATRIX = """
+BRK:imp ORA:izx KIL:imp SLO:izx NOP:zp  ORA:zp  ASL:zp  SLO:zp  PHP:imp ORA:imm ASL:acc ANC:imm NOP:abs ORA:abs ASL:abs SLO:abs
+BPL:rel ORA:izy KIL:imp SLO:izy NOP:zpx ORA:zpx ASL:zpx SLO:zpx CLC:imp ORA:aby NOP:imp SLO:aby NOP:abx ORA:abx ASL:abx SLO:abx
+JSR:abs AND:izx KIL:imp RLA:izx BIT:zp  AND:zp  ROL:zp  RLA:zp  PLP:imp AND:imm ROL:acc ANC:imm BIT:abs AND:abs ROL:abs RLA:abs
+BMI:rel AND:izy KIL:imp RLA:izy NOP:zpx AND:zpx ROL:zpx RLA:zpx SEC:imp AND:aby NOP:imp RLA:aby NOP:abx AND:abx ROL:abx RLA:abx
+RTI:imp EOR:izx KIL:imp SRE:izx NOP:zp  EOR:zp  LSR:zp  SRE:zp  PHA:imp EOR:imm LSR:acc ALR:imm JMP:abs EOR:abs LSR:abs SRE:abs
+BVC:rel EOR:izy KIL:imp SRE:izy NOP:zpx EOR:zpx LSR:zpx SRE:zpx CLI:imp EOR:aby NOP:imp SRE:aby NOP:abx EOR:abx LSR:abx SRE:abx
+RTS:imp ADC:izx KIL:imp RRA:izx NOP:zp  ADC:zp  ROR:zp  RRA:zp  PLA:imp ADC:imm ROR:acc ARR:imm JMP:ind ADC:abs ROR:abs RRA:abs
+BVS:rel ADC:izy KIL:imp RRA:izy NOP:zpx ADC:zpx ROR:zpx RRA:zpx SEI:imp ADC:aby NOP:imp RRA:aby NOP:abx ADC:abx ROR:abx RRA:abx
+NOP:imm STA:izx NOP:imm SAX:izx STY:zp  STA:zp  STX:zp  SAX:zp  DEY:imp NOP:imm TXA:imp XAA:imm STY:abs STA:abs STX:abs SAX:abs
+BCC:rel STA:izy KIL:imp AHX:izy STY:zpx STA:zpx STX:zpy SAX:zpy TYA:imp STA:aby TXS:imp TAS:aby SHY:abx STA:abx SHX:aby AHX:aby
+LDY:imm LDA:izx LDX:imm LAX:izx LDY:zp  LDA:zp  LDX:zp  LAX:zp  TAY:imp LDA:imm TAX:imp LAX:imm LDY:abs LDA:abs LDX:abs LAX:abs
+BCS:rel LDA:izy KIL:imp LAX:izy LDY:zpx LDA:zpx LDX:zpy LAX:zpy CLV:imp LDA:aby TSX:imp LAS:aby LDY:abx LDA:abx LDX:aby LAX:aby
+CPY:imm CMP:izx NOP:imm DCP:izx CPY:zp  CMP:zp  DEC:zp  DCP:zp  INY:imp CMP:imm DEX:imp AXS:imm CPY:abs CMP:abs DEC:abs DCP:abs
+BNE:rel CMP:izy KIL:imp DCP:izy NOP:zpx CMP:zpx DEC:zpx DCP:zpx CLD:imp CMP:aby NOP:imp DCP:aby NOP:abx CMP:abx DEC:abx DCP:abx
+CPX:imm SBC:izx NOP:imm ISC:izx CPX:zp  SBC:zp  INC:zp  ISC:zp  INX:imp SBC:imm NOP:imp SBC:imm CPX:abs SBC:abs INC:abs ISC:abs
+BEQ:rel SBC:izy KIL:imp ISC:izy NOP:zpx SBC:zpx INC:zpx ISC:zpx SED:imp SBC:aby NOP:imp ISC:aby NOP:abx SBC:abx INC:abx ISC:abx
+"""
+
+MODES = {"imp": IMP, "acc": ACC, "imm": IMM, "zp": ZP, "zpx": ZPX, "zpy": ZPY, "abs": ABS,
+         "abx": ABX, "aby": ABY, "izx": IZX, "izy": IZY, "ind": IND, "rel": REL}
+
+OPCODES = []
+for token in MATRIX.split():
+    name, mode = token.split(":")
+    OPCODES.append((name, MODES[mode]))
+assert len(OPCODES) == 256
+
+READ = {"LDA", "LDX", "LDY", "ADC", "SBC", "AND", "ORA", "EOR", "CMP", "CPX", "CPY", "BIT",
+        "LAX", "NOP", "ANC", "ALR", "ARR", "AXS", "XAA", "LAS"}
+WRITE = {"STA", "STX", "STY", "SAX", "AHX", "SHX", "SHY", "TAS"}
+RMW = {"ASL", "LSR", "ROL", "ROR", "INC", "DEC", "SLO", "RLA", "SRE", "RRA", "DCP", "ISC"}
+BRANCH = {"BPL": (7, 0), "BMI": (7, 1), "BVC": (6, 0), "BVS": (6, 1),
+          "BCC": (0, 0), "BCS": (0, 1), "BNE": (1, 0), "BEQ": (1, 1)}
+
+C, Z, I, D, B, U, V, N = (1 << i for i in range(8))
+
+
+class CPU:
+    def __init__(self, rng, pc, s, a, x, y, p, ram):
+        self.rng = rng
+        self.pc, self.s, self.a, self.x, self.y, self.p = pc, s, a, x, y, p
+        self.ram = ram          # 已知的内存，没有的地址第一次访问时随机生成
+        self.initial = dict(ram)
+        self.cycles = []
+
+    def peek(self, addr):
+        if addr not in self.ram:
+            self.ram[addr] = self.initial[addr] = self.rng.randrange(256)
+        return self.ram[addr]
+
+    def read(self, addr):
+        addr &= 0xFFFF
+        value = self.peek(addr)
+        self.cycles.append([addr, value, "read"])
+        return value
+
+    def write(self, addr, value):
+        addr &= 0xFFFF
+        self.peek(addr)
+        self.ram[addr] = value & 0xFF
+        self.cycles.append([addr, value & 0xFF, "write"])
+
+    def flag(self, f, on):
+        self.p = (self.p | f) if on else (self.p & ~f & 0xFF)
+
+    def zn(self, v):
+        self.flag(Z, v & 0xFF == 0)
+        self.flag(N, v & 0x80)
+        return v & 0xFF
+
+    def push(self, v):
+        self.write(0x100 | self.s, v)
+        self.s = (self.s - 1) & 0xFF
+
+    def pull(self):
+        self.s = (self.s + 1) & 0xFF
+        return self.read(0x100 | self.s)
+
+    # 运算
+    def adc(self, m):
+        r = self.a + m + (self.p & C)
+        self.flag(V, (~(self.a ^ m) & (self.a ^ r)) & 0x80)
+        self.flag(C, r > 0xFF)
+        self.a = self.zn(r)
+
+    def sbc(self, m):
+        self.adc(m ^ 0xFF)
+
+    def cmp(self, reg, m):
+        self.flag(C, reg >= m)
+        self.zn(reg - m)
+
+    def alu(self, name, m):
+        if name == "LDA": self.a = self.zn(m)
+        elif name == "LDX": self.x = self.zn(m)
+        elif name == "LDY": self.y = self.zn(m)
+        elif name == "LAX": self.a = self.x = self.zn(m)
+        elif name == "ADC": self.adc(m)
+        elif name == "SBC": self.sbc(m)
+        elif name == "AND": self.a = self.zn(self.a & m)
+        elif name == "ORA": self.a = self.zn(self.a | m)
+        elif name == "EOR": self.a = self.zn(self.a ^ m)
+        elif name == "CMP": self.cmp(self.a, m)
+        elif name == "CPX": self.cmp(self.x, m)
+        elif name == "CPY": self.cmp(self.y, m)
+        elif name == "BIT":
+            self.flag(Z, self.a & m == 0)
+            self.flag(V, m & 0x40)
+            self.flag(N, m & 0x80)
+        elif name == "NOP": pass
+        elif name == "ANC":
+            self.a = self.zn(self.a & m)
+            self.flag(C, self.a & 0x80)
+        elif name == "ALR":
+            t = self.a & m
+            self.flag(C, t & 1)
+            self.a = self.zn(t >> 1)
+        elif name == "ARR":
+            t = self.a & m
+            self.a = self.zn((t >> 1) | ((self.p & C) << 7))
+            self.flag(C, self.a & 0x40)
+            self.flag(V, ((self.a >> 6) ^ (self.a >> 5)) & 1)
+        elif name == "AXS":
+            t = self.a & self.x
+            self.flag(C, t >= m)
+            self.x = self.zn(t - m)
+        elif name == "XAA": self.a = self.zn((self.a | 0xEE) & self.x & m)
+        elif name == "LAS": self.a = self.x = self.s = self.zn(m & self.s)
+        else: raise ValueError(name)
+
+    def shift(self, name, m):
+        """返回读-改-写的新值"""
+        c = self.p & C
+        if name in ("ASL", "SLO"):
+            self.flag(C, m & 0x80); r = (m << 1) & 0xFF
+        elif name in ("LSR", "SRE"):
+            self.flag(C, m & 1); r = m >> 1
+        elif name in ("ROL", "RLA"):
+            self.flag(C, m & 0x80); r = ((m << 1) | c) & 0xFF
+        elif name in ("ROR", "RRA"):
+            self.flag(C, m & 1); r = (m >> 1) | (c << 7)
+        elif name in ("INC", "ISC"):
+            r = (m + 1) & 0xFF
+        elif name in ("DEC", "DCP"):
+            r = (m - 1) & 0xFF
+        if name in ("ASL", "LSR", "ROL", "ROR", "INC", "DEC"): self.zn(r)
+        elif name == "SLO": self.a = self.zn(self.a | r)
+        elif name == "RLA": self.a = self.zn(self.a & r)
+        elif name == "SRE": self.a = self.zn(self.a ^ r)
+        elif name == "RRA": self.adc(r)
+        elif name == "DCP": self.cmp(self.a, r)
+        elif name == "ISC": self.sbc(r)
+        return r
+
+    def store_value(self, name):
+        if name == "STA": return self.a
+        if name == "STX": return self.x
+        if name == "STY": return self.y
+        if name == "SAX": return self.a & self.x
+        raise ValueError(name)
+
+    # 变址寻址: 先按没有进位的高字节读一次，跨页或者写/读改写时总会有这一次
+    def indexed(self, name, base, index):
+        addr = (base + index) & 0xFFFF
+        crossed = (base ^ addr) & 0xFF00
+        if crossed or name not in READ:
+            self.read((base & 0xFF00) | (addr & 0xFF))
+        return addr, crossed
+
+    def operate(self, name, addr, base=None):
+        if name in READ:
+            self.alu(name, self.read(addr))
+        elif name in RMW:
+            m = self.read(addr)
+            self.write(addr, m)
+            self.write(addr, self.shift(name, m))
+        elif name in ("AHX", "SHX", "SHY", "TAS"):
+            # 写入 value & (基址高字节+1)，跨页时高字节被替换成写入的值
+            if name == "TAS":
+                self.s = self.a & self.x
+                v = self.s
+            else:
+                v = {"AHX": self.a & self.x, "SHX": self.x, "SHY": self.y}[name]
+            v &= ((base >> 8) + 1) & 0xFF
+            if (base ^ addr) & 0xFF00:
+                addr = (v << 8) | (addr & 0xFF)
+            self.write(addr, v)
+        else:
+            self.write(addr, self.store_value(name))
+
+    def step(self):
+        op = self.read(self.pc)
+        name, mode = OPCODES[op]
+        pc = self.pc
+
+        if name == "KIL":
+            # 卡死，之后的总线行为和模拟器不同，只记前两个时钟，测试只检查卡死状态
+            self.read(pc + 1)
+            return
+        if name == "BRK":
+            self.read(pc + 1)
+            ret = (pc + 2) & 0xFFFF
+            self.push(ret >> 8); self.push(ret & 0xFF)
+            self.push(self.p | B | U)
+            self.flag(I, True)
+            lo = self.read(0xFFFE); hi = self.read(0xFFFF)
+            self.pc = hi << 8 | lo
+            return
+        if name == "JSR":
+            lo = self.read(pc + 1)
+            self.read(0x100 | self.s)
+            ret = (pc + 2) & 0xFFFF
+            self.push(ret >> 8); self.push(ret & 0xFF)
+            hi = self.read(pc + 2)
+            self.pc = hi << 8 | lo
+            return
+        if name == "RTS":
+            self.read(pc + 1)
+            self.read(0x100 | self.s)
+            lo = self.pull(); hi = self.pull()
+            addr = hi << 8 | lo
+            self.read(addr)
+            self.pc = (addr + 1) & 0xFFFF
+            return
+        if name == "RTI":
+            self.read(pc + 1)
+            self.read(0x100 | self.s)
+            self.p = self.pull() & ~B & 0xFF | U
+            lo = self.pull(); hi = self.pull()
+            self.pc = hi << 8 | lo
+            return
+        if name in ("PHA", "PHP"):
+            self.read(pc + 1)
+            self.push(self.a if name == "PHA" else self.p | B | U)
+            self.pc = (pc + 1) & 0xFFFF
+            return
+        if name in ("PLA", "PLP"):
+            self.read(pc + 1)
+            self.read(0x100 | self.s)
+            v = self.pull()
+            if name == "PLA":
+                self.a = self.zn(v)
+            else:
+                self.p = v & ~B & 0xFF | U
+            self.pc = (pc + 1) & 0xFFFF
+            return
+        if name == "JMP":
+            lo = self.read(pc + 1); hi = self.read(pc + 2)
+            target = hi << 8 | lo
+            if mode == IND:
+                # 指针跨页时高字节从同一页开头读
+                lo = self.read(target)
+                hi = self.read((target & 0xFF00) | ((target + 1) & 0xFF))
+                target = hi << 8 | lo
+            self.pc = target
+            return
+        if mode == REL:
+            off = self.read(pc + 1)
+            self.pc = (pc + 2) & 0xFFFF
+            bit, want = BRANCH[name]
+            if (self.p >> bit) & 1 == want:
+                target = (self.pc + (off - 256 if off >= 0x80 else off)) & 0xFFFF
+                self.read(self.pc)
+                if (target ^ self.pc) & 0xFF00:
+                    self.read((self.pc & 0xFF00) | (target & 0xFF))
+                self.pc = target
+            return
+        if mode in (IMP, ACC):
+            self.read(pc + 1)
+            self.pc = (pc + 1) & 0xFFFF
+            self.implied(name)
+            return
+        if mode == IMM:
+            self.pc = (pc + 2) & 0xFFFF
+            m = self.read(pc + 1)
+            if name == "LAX":
+                m &= self.a | 0xEE
+            self.alu(name, m)
+            return
+        if mode == ZP:
+            addr = self.read(pc + 1)
+            self.pc = (pc + 2) & 0xFFFF
+            self.operate(name, addr)
+            return
+        if mode in (ZPX, ZPY):
+            base = self.read(pc + 1)
+            self.read(base)
+            addr = (base + (self.x if mode == ZPX else self.y)) & 0xFF
+            self.pc = (pc + 2) & 0xFFFF
+            self.operate(name, addr)
+            return
+        if mode == ABS:
+            lo = self.read(pc + 1); hi = self.read(pc + 2)
+            self.pc = (pc + 3) & 0xFFFF
+            self.operate(name, hi << 8 | lo)
+            return
+        if mode in (ABX, ABY):
+            lo = self.read(pc + 1); hi = self.read(pc + 2)
+            self.pc = (pc + 3) & 0xFFFF
+            base = hi << 8 | lo
+            addr, _ = self.indexed(name, base, self.x if mode == ABX else self.y)
+            self.operate(name, addr, base)
+            return
+        if mode == IZX:
+            ptr = self.read(pc + 1)
+            self.read(ptr)
+            ptr = (ptr + self.x) & 0xFF
+            lo = self.read(ptr); hi = self.read((ptr + 1) & 0xFF)
+            self.pc = (pc + 2) & 0xFFFF
+            self.operate(name, hi << 8 | lo)
+            return
+        if mode == IZY:
+            ptr = self.read(pc + 1)
+            lo = self.read(ptr); hi = self.read((ptr + 1) & 0xFF)
+            self.pc = (pc + 2) & 0xFFFF
+            base = hi << 8 | lo
+            addr, _ = self.indexed(name, base, self.y)
+            self.operate(name, addr, base)
+            return
+        raise ValueError((name, mode))
+
+    def implied(self, name):
+        if name in ("ASL", "LSR", "ROL", "ROR"):
+            c = self.p & C
+            m = self.a
+            if name == "ASL": self.flag(C, m & 0x80); self.a = self.zn(m << 1)
+            elif name == "LSR": self.flag(C, m & 1); self.a = self.zn(m >> 1)
+            elif name == "ROL": self.flag(C, m & 0x80); self.a = self.zn((m << 1) | c)
+            else: self.flag(C, m & 1); self.a = self.zn((m >> 1) | (c << 7))
+        elif name == "CLC": self.flag(C, False)
+        elif name == "SEC": self.flag(C, True)
+        elif name == "CLI": self.flag(I, False)
+        elif name == "SEI": self.flag(I, True)
+        elif name == "CLV": self.flag(V, False)
+        elif name == "CLD": self.flag(D, False)
+        elif name == "SED": self.flag(D, True)
+        elif name == "INX": self.x = self.zn(self.x + 1)
+        elif name == "INY": self.y = self.zn(self.y + 1)
+        elif name == "DEX": self.x = self.zn(self.x - 1)
+        elif name == "DEY": self.y = self.zn(self.y - 1)
+        elif name == "TAX": self.x = self.zn(self.a)
+        elif name == "TAY": self.y = self.zn(self.a)
+        elif name == "TXA": self.a = self.zn(self.x)
+        elif name == "TYA": self.a = self.zn(self.y)
+        elif name == "TSX": self.x = self.zn(self.s)
+        elif name == "TXS": self.s = self.x
+        elif name == "NOP": pass
+        else: raise ValueError(name)
+
+
+def make_case(rng, op):
+    name, mode = OPCODES[op]
+    pc = rng.randrange(0x10000)
+    regs = dict(s=rng.randrange(256), a=rng.randrange(256), x=rng.randrange(256),
+                y=rng.randrange(256), p=rng.randrange(256) | U)
+    ram = {pc: op}
+    cpu = CPU(rng, pc, ram=ram, **regs)
+    # 指令的操作数字节先定下来，名字里要用
+    size = {IMP: 1, ACC: 1, IMM: 2, ZP: 2, ZPX: 2, ZPY: 2, REL: 2, IZX: 2, IZY: 2}.get(mode, 3)
+    if name in ("BRK",):
+        size = 1
+    operand = [cpu.peek((pc + i) & 0xFFFF) for i in range(1, size)]
+    initial = dict(pc=pc, **regs)
+    cpu.step()
+    mem_initial = sorted(cpu.initial.items())
+    final = dict(pc=cpu.pc, s=cpu.s, a=cpu.a, x=cpu.x, y=cpu.y, p=cpu.p | U)
+    initial["ram"] = [[a, v] for a, v in mem_initial]
+    final["ram"] = [[a, cpu.ram[a]] for a, _ in mem_initial]
+    return {
+        "name": " ".join("%02x" % b for b in [op] + operand),
+        "initial": initial,
+        "final": final,
+        "cycles": cpu.cycles,
+    }
+
+
+def main():
+    count = int(sys.argv[1]) if len(sys.argv) > 1 else 8
+    for op in range(256):
+        rng = random.Random(op)
+        cases = [make_case(rng, op) for _ in range(count)]
+        with open("%02x.json" % op, "w") as f:
+            f.write("[\n")
+            f.write(",\n".join("  " + json.dumps(c, separators=(", ", ": ")) for c in cases))
+            f.write("\n]\n")
+
+
+if __name__ == "__main__":
+    main()
@@ -0,0 +1,241 @@
+package nes
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+CPU指令跟踪
+每条指令执行前调用Tracer，TraceLogger按nestest.log的格式输出，方便和其他模拟器的日志对比:
+
+C000  4C F5 C5  JMP $C5F5                       A:00 X:00 Y:00 P:24 SP:FD PPU:  0, 21 CYC:7
+C6BD  04 A9    *NOP $A9 = 00                    A:AA X:97 Y:4E P:EF SP:F5 PPU: 50,  1 CYC:3438
+*/
+
+// 在CPU取下一条指令前调用，此时PC指向将要执行的指令
+type Tracer interface {
+	Trace(cpu *CPU)
+}
+
+// 运行中随时挂载/卸载，nil表示关闭跟踪
+func (cpu *CPU) SetTracer(tracer Tracer) {
+	cpu.tracer = tracer
+}
+
+// 可以无副作用读取内存的Memory实现，跟踪时用来显示操作数的值
+// 比如读$2002会清除VBlank标志，跟踪时不能真的去读
+type Peeker interface {
+	Peek(addr uint16) byte
+}
+
+// mapper可以实现这个接口，告诉跟踪器CPU地址对应PRG-ROM的哪个位置，用来按bank过滤
+type PRGMapper interface {
+	// 返回addr在PRG-ROM中的偏移，不是PRG-ROM时返回-1
+	PRGOffset(addr uint16) int
+}
+
+// 按bank过滤时bank的大小，8KB是常见mapper里最小的PRG bank
+const TraceBankSize = 0x2000
+
+type TraceLogger struct {
+	console *Console
+	w       *bufio.Writer
+	closer  io.Closer
+
+	minPC uint16
+	maxPC uint16
+	bank  int // -1 表示不过滤
+	err   error
+}
+
+// 写到w，内部带缓冲，结束时要调用Flush或Close
+func NewTraceLogger(w io.Writer, console *Console) *TraceLogger {
+	return &TraceLogger{
+		console: console,
+		w:       bufio.NewWriterSize(w, 64*1024),
+		maxPC:   0xffff,
+		bank:    -1,
+	}
+}
+
+// 创建文件并写入跟踪日志
+func CreateTraceFile(path string, console *Console) (*TraceLogger, error) {
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	t := NewTraceLogger(file, console)
+	t.closer = file
+	return t, nil
+}
+
+// 只记录PC在[min, max]范围内的指令
+func (t *TraceLogger) SetPCRange(min, max uint16) {
+	t.minPC = min
+	t.maxPC = max
+}
+
+// 只记录位于PRG-ROM第bank个8KB块里的指令，-1表示不过滤
+// mapper没有实现PRGMapper时按$8000起的CPU地址计算
+func (t *TraceLogger) SetBank(bank int) {
+	t.bank = bank
+}
+
+func (t *TraceLogger) Trace(cpu *CPU) {
+	if t.err != nil {
+		return
+	}
+	pc := cpu.PC
+	if pc < t.minPC || pc > t.maxPC {
+		return
+	}
+	if t.bank >= 0 && t.prgBank(pc) != t.bank {
+		return
+	}
+	ppu := t.console.PPU
+	_, t.err = fmt.Fprintln(t.w, TraceLine(cpu, ppu.ScanLine, ppu.Cycle))
+}
+
+func (t *TraceLogger) prgBank(pc uint16) int {
+	if m, ok := t.console.Mapper.(PRGMapper); ok {
+		offset := m.PRGOffset(pc)
+		if offset < 0 {
+			return -1
+		}
+		return offset / TraceBankSize
+	}
+	if pc < 0x8000 {
+		return -1
+	}
+	return int(pc-0x8000) / TraceBankSize
+}
+
+// 写入过程中第一次出错的错误
+func (t *TraceLogger) Err() error {
+	return t.err
+}
+
+func (t *TraceLogger) Flush() error {
+	if err := t.w.Flush(); err != nil && t.err == nil {
+		t.err = err
+	}
+	return t.err
+}
+
+func (t *TraceLogger) Close() error {
+	err := t.Flush()
+	if t.closer != nil {
+		if cerr := t.closer.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// 跟踪时读内存，优先使用无副作用的Peek
+func (cpu *CPU) peek(addr uint16) byte {
+	if p, ok := cpu.Memory.(Peeker); ok {
+		return p.Peek(addr)
+	}
+	return cpu.Read(addr)
+}
+
+// 生成一行nestest格式的日志，scanLine/dot是当前PPU位置
+func TraceLine(cpu *CPU, scanLine int, dot int) string {
+	pc := cpu.PC
+	opcode := cpu.peek(pc)
+	size := instructionSizes[opcode]
+	if size == 0 {
+		size = 1
+	}
+
+	code := fmt.Sprintf("%02X", opcode)
+	for i := uint16(1); i < uint16(size); i++ {
+		code += fmt.Sprintf(" %02X", cpu.peek(pc+i))
+	}
+
+	// 非官方指令前面带*
+	mark := " "
+	if isUnofficial(opcode) {
+		mark = "*"
+	}
+
+	return fmt.Sprintf("%04X  %-8s %s%-31s A:%02X X:%02X Y:%02X P:%02X SP:%02X PPU:%3d,%3d CYC:%d",
+		pc, code, mark, cpu.disassemble(pc), cpu.A, cpu.X, cpu.Y, cpu.getFlags(), cpu.SP, scanLine, dot, cpu.Cycles)
+}
+
+// 反汇编pc处的指令，操作数的格式和nestest.log一致
+func (cpu *CPU) disassemble(pc uint16) string {
+	opcode := cpu.peek(pc)
+	name := instructionNames[opcode]
+	b1 := cpu.peek(pc + 1)
+	b2 := cpu.peek(pc + 2)
+	abs := uint16(b2)<<8 | uint16(b1)
+
+	switch instructionModes[opcode] {
+	case modeImplied:
+		return name
+	case modeAccumulator:
+		return name + " A"
+	case modeImmediate:
+		return fmt.Sprintf("%s #$%02X", name, b1)
+	case modeZeroPage:
+		return fmt.Sprintf("%s $%02X = %02X", name, b1, cpu.peek(uint16(b1)))
+	case modeZeroPageX:
+		addr := b1 + cpu.X
+		return fmt.Sprintf("%s $%02X,X @ %02X = %02X", name, b1, addr, cpu.peek(uint16(addr)))
+	case modeZeroPageY:
+		addr := b1 + cpu.Y
+		return fmt.Sprintf("%s $%02X,Y @ %02X = %02X", name, b1, addr, cpu.peek(uint16(addr)))
+	case modeAbsolute:
+		// 跳转指令不显示目标地址的值
+		if name == "JMP" || name == "JSR" {
+			return fmt.Sprintf("%s $%04X", name, abs)
+		}
+		return fmt.Sprintf("%s $%04X = %02X", name, abs, cpu.peek(abs))
+	case modeAbsoluteX:
+		addr := abs + uint16(cpu.X)
+		return fmt.Sprintf("%s $%04X,X @ %04X = %02X", name, abs, addr, cpu.peek(addr))
+	case modeAbsoluteY:
+		addr := abs + uint16(cpu.Y)
+		return fmt.Sprintf("%s $%04X,Y @ %04X = %02X", name, abs, addr, cpu.peek(addr))
+	case modeIndirect:
+		return fmt.Sprintf("%s ($%04X) = %04X", name, abs, cpu.peek16bug(abs))
+	case modeIndexedIndirect:
+		ptr := b1 + cpu.X
+		addr := cpu.peek16bug(uint16(ptr))
+		return fmt.Sprintf("%s ($%02X,X) @ %02X = %04X = %02X", name, b1, ptr, addr, cpu.peek(addr))
+	case modeIndirectIndexed:
+		base := cpu.peek16bug(uint16(b1))
+		addr := base + uint16(cpu.Y)
+		return fmt.Sprintf("%s ($%02X),Y = %04X @ %04X = %02X", name, b1, base, addr, cpu.peek(addr))
+	case modeRelative:
+		target := pc + 2 + uint16(int8(b1))
+		return fmt.Sprintf("%s $%04X", name, target)
+	}
+	return name
+}
+
+func (cpu *CPU) peek16bug(address uint16) uint16 {
+	b := (address & 0xFF00) | uint16(byte(address)+1)
+	return uint16(cpu.peek(b))<<8 | uint16(cpu.peek(address))
+}
+
+// 官方指令之外的都是非官方指令，包括非官方的NOP和SBC
+func isUnofficial(opcode byte) bool {
+	switch opcode {
+	case 0xEA:
+		return false
+	case 0xEB:
+		return true
+	}
+	switch instructionNames[opcode] {
+	case "NOP", "KIL", "SLO", "RLA", "SRE", "RRA", "SAX", "LAX", "DCP", "ISC",
+		"ANC", "ALR", "ARR", "XAA", "AXS", "AHX", "SHX", "SHY", "TAS", "LAS":
+		return true
+	}
+	return false
+}
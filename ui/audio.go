@@ -6,17 +6,34 @@ import (
 	"github.com/gordonklaus/portaudio"
 )
 
+// 缓冲区大小，越大声音延迟越大
+const audioBufferSize = 8192
+
+// 动态码率控制的目标水位，也是同步音频时的节奏
+const audioTargetFill = 0.5
+
+// 根据水位调整采样率的最大幅度，0.5%的音调变化听不出来
+const audioMaxRateDelta = 0.005
+
+// 每产生这么多采样调整一次采样率
+const audioRateInterval = 512
+
+// 为true且声卡有两个以上声道时输出立体声，声像在混音设置里调整
+var Stereo bool
+
 type Audio struct {
 	stream         *portaudio.Stream
 	sampleRate     float64
 	outputChannels int
-	channel        chan float32
+	buffer         *ringBuffer
+	last           [2]float32 // 缓冲区空的时候重复最后一个采样，避免跳到0产生爆音
+	count          int
+	stereo         bool // 立体声时缓冲区里左右声道交错
 }
 
 func NewAudio() *Audio {
 	a := Audio{}
-	// channel通道作为缓存区，越大声音延迟越大
-	a.channel = make(chan float32, 8192)
+	a.buffer = newRingBuffer(audioBufferSize)
 	return &a
 }
 
@@ -36,31 +53,71 @@ func (audio *Audio) RunAudio(console *nes.Console) {
 	// 给apu设置输出通道、和帧率
 	console.SetAudioSampleRate(audio.sampleRate)
 	// console.SetAudioChannel(audio.channel)
-	// 这里改为回调
-	console.SetAudioOutputWork(func(f float32) {
-		audio.channel <- f
-	})
+	// 这里改为回调，回调在模拟的goroutine中执行，缓冲区满了直接丢掉
+	audio.stereo = Stereo && audio.outputChannels >= 2
+	if audio.stereo {
+		console.SetAudioStereoOutputWork(func(left, right float32) {
+			// 左右一起写，不然丢采样时两个声道会错位
+			if audio.buffer.cap()-audio.buffer.len() >= 2 {
+				audio.buffer.push(left)
+				audio.buffer.push(right)
+			}
+			audio.sampleWritten(console)
+		})
+	} else {
+		console.SetAudioOutputWork(func(f float32) {
+			audio.buffer.push(f)
+			audio.sampleWritten(console)
+		})
+	}
 
 	err2 := stream.Start()
 	Check(err2)
 }
 
+func (audio *Audio) sampleWritten(console *nes.Console) {
+	audio.count++
+	if audio.count%audioRateInterval == 0 {
+		audio.adjustRate(console)
+	}
+}
+
+// 缓冲区水位，0为空，1为满
+func (a *Audio) Fill() float64 {
+	return float64(a.buffer.len()) / float64(a.buffer.cap())
+}
+
+// 动态码率控制: 模拟的时钟和声卡的时钟总有微小误差，缓冲区会慢慢变空或者变满，
+// 水位高于目标时让APU少出一点采样，低于目标时多出一点，把水位稳定在目标附近
+func (a *Audio) adjustRate(console *nes.Console) {
+	delta := (audioTargetFill - a.Fill()) / audioTargetFill * audioMaxRateDelta
+	if delta > audioMaxRateDelta {
+		delta = audioMaxRateDelta
+	} else if delta < -audioMaxRateDelta {
+		delta = -audioMaxRateDelta
+	}
+	console.SetAudioSampleRate(a.sampleRate * (1 + delta))
+}
+
 func (a *Audio) Stop() error {
 	return a.stream.Close()
 }
 
+// 单声道时所有声道输出一样的采样，立体声时偶数声道为左，奇数声道为右
 func (audio *Audio) Callback(out []float32) {
-	var output float32
-	for i := range out {
-		if i%audio.outputChannels == 0 {
-			select {
-			case sample := <-audio.channel:
-				output = sample
-			default:
-				output = 0
+	channels := audio.outputChannels
+	for i := 0; i+channels <= len(out); i += channels {
+		if !audio.stereo {
+			if sample, ok := audio.buffer.pop(); ok {
+				audio.last[0], audio.last[1] = sample, sample
 			}
+		} else if audio.buffer.len() >= 2 {
+			audio.last[0], _ = audio.buffer.pop()
+			audio.last[1], _ = audio.buffer.pop()
+		}
+		for c := 0; c < channels; c++ {
+			out[i+c] = audio.last[c%2]
 		}
-		out[i] = output
 	}
 }
 
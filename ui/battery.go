@@ -0,0 +1,83 @@
+package ui
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/55utah/fc-simulator/nes"
+)
+
+// 电池存档定时写盘的间隔
+const batteryFlushInterval = 5 * time.Second
+
+// 负责把带电池的SRAM存到rom旁边的.sav文件
+type BatterySaver struct {
+	console *nes.Console
+	path    string
+	last    []byte // 上次写盘的内容，没有变化就不重复写
+	mu      sync.Mutex
+}
+
+func NewBatterySaver(console *nes.Console, romPath string) *BatterySaver {
+	path := strings.TrimSuffix(romPath, filepath.Ext(romPath)) + ".sav"
+	return &BatterySaver{console: console, path: path}
+}
+
+// 启动时读取.sav文件，文件不存在时不做处理
+func (s *BatterySaver) Load() error {
+	if !s.console.HasBattery() {
+		return nil
+	}
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.console.ImportBatteryRAM(data); err != nil {
+		return err
+	}
+	s.last = s.console.ExportBatteryRAM()
+	return nil
+}
+
+// SRAM有变化时写入.sav文件
+func (s *BatterySaver) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	consoleLock.Lock()
+	data := s.console.ExportBatteryRAM()
+	consoleLock.Unlock()
+	if data == nil || bytes.Equal(data, s.last) {
+		return nil
+	}
+	// 先写临时文件再改名，避免写到一半退出损坏存档
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	s.last = data
+	return nil
+}
+
+// 定时写盘，和RunView一样在单独的goroutine中运行
+func (s *BatterySaver) Run() {
+	if !s.console.HasBattery() {
+		return
+	}
+	for range time.Tick(batteryFlushInterval) {
+		if err := s.Flush(); err != nil {
+			fmt.Printf("save battery RAM: %v\n", err)
+		}
+	}
+}
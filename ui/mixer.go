@@ -0,0 +1,71 @@
+package ui
+
+import (
+	"fmt"
+	"strings"
+
+	"fyne.io/fyne"
+
+	"github.com/55utah/fc-simulator/nes"
+)
+
+// 声道开关按键: Z/X/C/V/B/M 分别静音方波1/方波2/三角波/噪声/DMC/卡带扩展音源，N 依次独奏各声道
+var channelKeys = map[fyne.KeyName]int{
+	"Z": nes.ChannelPulse1,
+	"X": nes.ChannelPulse2,
+	"C": nes.ChannelTriangle,
+	"V": nes.ChannelNoise,
+	"B": nes.ChannelDMC,
+	"M": nes.ChannelExpansion,
+}
+
+// 返回需要显示给用户的提示，没有处理返回空字符串
+func keyParseMixer(ev *fyne.KeyEvent, console *nes.Console) string {
+	channel, ok := channelKeys[ev.Name]
+	if !ok && ev.Name != "N" {
+		return ""
+	}
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	mixer := console.Mixer()
+	if ok {
+		mixer[channel].Muted = !mixer[channel].Muted
+	} else {
+		nextSolo(&mixer)
+	}
+	console.SetMixer(mixer)
+	return mixerStatus(&mixer)
+}
+
+// 没有独奏时独奏方波1，之后依次换下一个声道，最后一个之后取消独奏
+func nextSolo(mixer *nes.Mixer) {
+	next := 0
+	for i := range mixer {
+		if mixer[i].Solo {
+			next = i + 1
+		}
+		mixer[i].Solo = false
+	}
+	if next < nes.ChannelCount {
+		mixer[next].Solo = true
+	}
+}
+
+func mixerStatus(mixer *nes.Mixer) string {
+	var muted, solo []string
+	for i, ch := range mixer {
+		if ch.Muted {
+			muted = append(muted, nes.ChannelName(i))
+		}
+		if ch.Solo {
+			solo = append(solo, nes.ChannelName(i))
+		}
+	}
+	switch {
+	case len(solo) > 0:
+		return "solo " + strings.Join(solo, ",")
+	case len(muted) > 0:
+		return "mute " + strings.Join(muted, ",")
+	}
+	return fmt.Sprintf("all %d channels on", nes.ChannelCount)
+}
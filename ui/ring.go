@@ -0,0 +1,54 @@
+package ui
+
+import (
+	"sync/atomic"
+)
+
+// 单生产者单消费者的无锁环形缓冲区:
+// 模拟goroutine在APU出采样时写入，portaudio的回调线程读取，两边都不会阻塞
+type ringBuffer struct {
+	// 读写位置只增不减，对size取模得到下标，放在最前面保证64位对齐
+	read  uint64
+	write uint64
+	data  []float32
+	mask  uint64
+}
+
+// size向上取2的幂
+func newRingBuffer(size int) *ringBuffer {
+	n := 1
+	for n < size {
+		n <<= 1
+	}
+	return &ringBuffer{data: make([]float32, n), mask: uint64(n - 1)}
+}
+
+// 满了返回false，丢掉这个采样
+func (r *ringBuffer) push(v float32) bool {
+	w := atomic.LoadUint64(&r.write)
+	if w-atomic.LoadUint64(&r.read) == uint64(len(r.data)) {
+		return false
+	}
+	r.data[w&r.mask] = v
+	atomic.StoreUint64(&r.write, w+1)
+	return true
+}
+
+// 空的时候返回false
+func (r *ringBuffer) pop() (float32, bool) {
+	rd := atomic.LoadUint64(&r.read)
+	if rd == atomic.LoadUint64(&r.write) {
+		return 0, false
+	}
+	v := r.data[rd&r.mask]
+	atomic.StoreUint64(&r.read, rd+1)
+	return v, true
+}
+
+func (r *ringBuffer) len() int {
+	return int(atomic.LoadUint64(&r.write) - atomic.LoadUint64(&r.read))
+}
+
+func (r *ringBuffer) cap() int {
+	return len(r.data)
+}
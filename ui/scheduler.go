@@ -0,0 +1,66 @@
+package ui
+
+import (
+	"time"
+)
+
+// 落后太多时(比如窗口被拖动、机器休眠)最多连续补这么多帧，剩下的直接丢掉
+const maxCatchUpFrames = 4
+
+// Scheduler 控制模拟的节奏，每次Wait返回这次要运行的帧数
+// 默认按墙上时钟以固定帧率推进，也可以改为按音频缓冲区的水位推进，
+// 后者声音不会因为时钟和声卡的微小误差而断续，但帧率跟着声卡走
+type Scheduler struct {
+	frame time.Duration // 每帧时长
+	next  time.Time     // 下一帧应该开始的时间，time.Now带单调时钟，不受系统时间调整影响
+
+	// 返回音频缓冲区水位(0-1)，为nil时按时钟推进
+	fill func() float64
+}
+
+// frameRate为每秒帧数，NTSC约60.0988，PAL约50.007，用Console.FrameRate获取
+func NewScheduler(frameRate float64) *Scheduler {
+	s := &Scheduler{frame: time.Duration(float64(time.Second) / frameRate)}
+	s.Reset()
+	return s
+}
+
+// 按音频缓冲区水位推进，fill为nil时恢复按时钟推进
+func (s *Scheduler) SetAudioSync(fill func() float64) {
+	s.fill = fill
+	s.Reset()
+}
+
+// 从现在重新计时，暂停或倒带之后调用，不补中间的时间
+func (s *Scheduler) Reset() {
+	s.next = time.Now()
+}
+
+// 等到下一帧该运行的时候，返回要运行的帧数，落后时大于1
+func (s *Scheduler) Wait() int {
+	if s.fill != nil {
+		return s.waitAudio()
+	}
+	now := time.Now()
+	if now.Before(s.next) {
+		time.Sleep(s.next.Sub(now))
+		now = time.Now()
+	}
+	frames := 1 + int(now.Sub(s.next)/s.frame)
+	if frames > maxCatchUpFrames {
+		frames = maxCatchUpFrames
+		s.next = now.Add(s.frame)
+	} else {
+		s.next = s.next.Add(time.Duration(frames) * s.frame)
+	}
+	return frames
+}
+
+// 缓冲区足够时睡一小会儿，不够了就运行一帧
+func (s *Scheduler) waitAudio() int {
+	for s.fill() >= audioTargetFill {
+		time.Sleep(s.frame / 4)
+	}
+	s.next = time.Now().Add(s.frame)
+	return 1
+}
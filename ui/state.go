@@ -0,0 +1,69 @@
+package ui
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"fyne.io/fyne"
+
+	"github.com/55utah/fc-simulator/nes"
+)
+
+// 当前即时存档槽位 0-9
+var stateSlot = 0
+
+// 槽位文件放在rom旁边: xxx.st0 - xxx.st9
+func statePath(romPath string, slot int) string {
+	return fmt.Sprintf("%s.st%d", strings.TrimSuffix(romPath, filepath.Ext(romPath)), slot)
+}
+
+func SaveSlot(console *nes.Console, romPath string, slot int) error {
+	file, err := os.Create(statePath(romPath, slot))
+	if err != nil {
+		return err
+	}
+	consoleLock.Lock()
+	err = console.SaveState(file)
+	consoleLock.Unlock()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+func LoadSlot(console *nes.Console, romPath string, slot int) error {
+	file, err := os.Open(statePath(romPath, slot))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	return console.LoadState(file)
+}
+
+// 即时存档按键: 0-9 选择槽位, F5 存档, F7 读档
+// 返回需要显示给用户的提示，没有处理返回空字符串
+func keyParseState(ev *fyne.KeyEvent, console *nes.Console, romPath string) string {
+	switch ev.Name {
+	case "0", "1", "2", "3", "4", "5", "6", "7", "8", "9":
+		stateSlot = int(ev.Name[0] - '0')
+		return fmt.Sprintf("slot %d", stateSlot)
+	case "F5":
+		if err := SaveSlot(console, romPath, stateSlot); err != nil {
+			fmt.Printf("save state: %v\n", err)
+			return fmt.Sprintf("slot %d save failed", stateSlot)
+		}
+		return fmt.Sprintf("slot %d saved", stateSlot)
+	case "F7":
+		if err := LoadSlot(console, romPath, stateSlot); err != nil {
+			fmt.Printf("load state: %v\n", err)
+			return fmt.Sprintf("slot %d load failed", stateSlot)
+		}
+		return fmt.Sprintf("slot %d loaded", stateSlot)
+	}
+	return ""
+}
@@ -5,6 +5,7 @@
 package ui
 
 import (
+	"fmt"
 	"image"
 	"time"
 
@@ -27,7 +28,7 @@ var height = 240
 
 var ratio = 2
 
-func OpenWindow(console *nes.Console) {
+func OpenWindow(console *nes.Console, romPath string) {
 
 	myApp := app.New()
 	w := myApp.NewWindow("FC")
@@ -40,10 +41,27 @@ func OpenWindow(console *nes.Console) {
 	// 禁止用户缩放窗口
 	w.SetFixedSize(true)
 
-	go func() {
-		RunView(console)
+	// 带电池的卡带启动时读取存档，运行中定时写盘，退出时再写一次
+	saver := NewBatterySaver(console, romPath)
+	if err := saver.Load(); err != nil {
+		fmt.Printf("load battery RAM: %v\n", err)
+	}
+	go saver.Run()
+	defer func() {
+		if err := saver.Flush(); err != nil {
+			fmt.Printf("save battery RAM: %v\n", err)
+		}
 	}()
 
+	// CPU卡死时在标题栏提示，按Q重置
+	console.SetJamCallback(func(err *nes.JamError) {
+		fmt.Println(err)
+		w.SetTitle(fmt.Sprintf("FC - CPU jammed at $%04X", err.PC))
+	})
+
+	// 开启倒带，按住退格键往回播放
+	console.EnableRewind(nes.DefaultRewindInterval, nes.DefaultRewindBudget)
+
 	if deskCanvas, ok := w.Canvas().(desktop.Canvas); ok {
 		deskCanvas.SetOnKeyDown(func(ev *fyne.KeyEvent) {
 			if console == nil {
@@ -58,6 +76,17 @@ func OpenWindow(console *nes.Console) {
 				w.CenterOnScreen()
 			})
 
+			if msg := keyParseState(ev, console, romPath); msg != "" {
+				w.SetTitle("FC - " + msg)
+			}
+			if msg := keyParseMixer(ev, console); msg != "" {
+				w.SetTitle("FC - " + msg)
+			}
+
+			if ev.Name == fyne.KeyBackspace {
+				setRewinding(true)
+			}
+
 			if index1 >= 0 {
 				ctrl1[index1] = true
 				console.SetButton1(ctrl1)
@@ -75,6 +104,10 @@ func OpenWindow(console *nes.Console) {
 			index1 := keyParse1(ev)
 			index2 := keyParse2(ev)
 
+			if ev.Name == fyne.KeyBackspace {
+				setRewinding(false)
+			}
+
 			if index1 >= 0 {
 				ctrl1[index1] = false
 				console.SetButton1(ctrl1)
@@ -105,8 +138,17 @@ func OpenWindow(console *nes.Console) {
 	audio.RunAudio(console)
 	defer audio.Stop()
 
+	// 按主机区域的帧率推进模拟
+	scheduler := NewScheduler(console.FrameRate())
+	if SyncToAudio {
+		scheduler.SetAudioSync(audio.Fill)
+	}
+	go RunView(console, scheduler)
+
 	w.SetContent(raster)
 	w.ShowAndRun()
+	// 窗口关闭后先停下模拟，返回之后调用方可以放心释放console用到的资源
+	stopView()
 }
 
 func changeContent(raster *canvas.Raster, getFrame func() image.Image) {
@@ -122,7 +164,9 @@ func keyParseSys(ev *fyne.KeyEvent, console *nes.Console, resizeWindow func()) {
 	switch ev.Name {
 	// 重置游戏
 	case "Q":
+		consoleLock.Lock()
 		console.Reset()
+		consoleLock.Unlock()
 	// 缩小屏幕
 	case "-":
 		if ratio > 1 {
@@ -1,27 +1,84 @@
 package ui
 
 import (
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/55utah/fc-simulator/nes"
 )
 
-var stop bool = false
-var timestamp float64
+// stopView设置为1后RunView退出，退出时关闭viewDone
+var stop int32
+var viewDone = make(chan struct{})
 
-func floatSecond() float64 {
-	return float64(time.Now().Nanosecond()) * float64(1e-9)
+// 为true时按音频缓冲区的水位控制节奏，否则按时钟
+var SyncToAudio bool
+
+// 按住倒带键时为1，模拟停止前进，按帧率往回播放
+// 按键回调和模拟不在同一个goroutine，用原子操作读写
+var rewinding int32
+var lastRewind time.Time
+
+// 倒带时每画面帧回退一次
+const rewindStep = time.Second / 60
+
+// 模拟在单独的goroutine中运行，存档/读档等操作console的地方要先拿到这把锁
+var consoleLock sync.Mutex
+
+func RunView(console *nes.Console, scheduler *Scheduler) {
+	defer close(viewDone)
+	for atomic.LoadInt32(&stop) == 0 {
+		RunStep(console, scheduler)
+	}
+}
+
+// 让RunView停下并等它退出，要在关闭音频之前调用，否则按音频同步时会一直等缓冲区
+func stopView() {
+	atomic.StoreInt32(&stop, 1)
+	<-viewDone
 }
 
-func RunView(console *nes.Console) {
-	timestamp = floatSecond()
-	for !stop {
-		RunStep(console)
+// 在模拟goroutine之外操作console时拿着模拟用的锁执行f
+func WithConsoleLock(f func()) {
+	consoleLock.Lock()
+	defer consoleLock.Unlock()
+	f()
+}
+
+// 等到该运行的时候按整帧推进，CPU卡死由SetJamCallback处理，这里不用管返回值
+func RunStep(console *nes.Console, scheduler *Scheduler) {
+	if isRewinding() {
+		RunRewind(console, scheduler)
+		return
+	}
+	frames := scheduler.Wait()
+	consoleLock.Lock()
+	console.RunFrames(frames, nil)
+	consoleLock.Unlock()
+}
+
+func setRewinding(on bool) {
+	var v int32
+	if on {
+		v = 1
 	}
+	atomic.StoreInt32(&rewinding, v)
 }
 
-func RunStep(console *nes.Console) {
-	current := floatSecond()
-	console.StepSeconds(current - timestamp)
-	timestamp = current
+func isRewinding() bool {
+	return atomic.LoadInt32(&rewinding) != 0
+}
+
+// 倒带时不前进，每画面帧倒退一帧，RewindFrames内部静音运行到目标帧用来刷新画面
+func RunRewind(console *nes.Console, scheduler *Scheduler) {
+	if time.Since(lastRewind) >= rewindStep {
+		consoleLock.Lock()
+		console.RewindFrames(1)
+		consoleLock.Unlock()
+		lastRewind = time.Now()
+	}
+	time.Sleep(time.Millisecond)
+	// 松开按键后从当前时间继续计时，不补倒带期间的时间
+	scheduler.Reset()
 }